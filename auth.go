@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+)
+
+const (
+	//ScopeUpload allows uploading images and updating their info
+	ScopeUpload = "upload"
+	//ScopeDelete allows deleting images
+	ScopeDelete = "delete"
+	//ScopeReadPrivate allows reading info and list of images
+	ScopeReadPrivate = "read-private"
+	//ScopeAdmin allows everything
+	ScopeAdmin = "admin"
+)
+
+var validScopes = []string{ScopeUpload, ScopeDelete, ScopeReadPrivate, ScopeAdmin}
+
+//APIToken is a named token with a set of scopes. The name is only used
+//for recording which token has performed an operation in logs.
+type APIToken struct {
+	Name   string   `yaml:"name"`
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes"`
+}
+
+//UnmarshalYAML accepts plain strings as tokens as well
+//and gives them admin scope.
+func (t *APIToken) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var token string
+	if err := unmarshal(&token); err == nil {
+		*t = *newAdminToken(token)
+		return nil
+	}
+	type plain APIToken
+	return unmarshal((*plain)(t))
+}
+
+func newAdminToken(token string) *APIToken {
+	return &APIToken{Name: "default", Token: token, Scopes: []string{ScopeAdmin}}
+}
+
+func (t *APIToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func validateTokens(tokens []*APIToken) error {
+	for _, t := range tokens {
+		if len(t.Token) == 0 {
+			return fmt.Errorf("Empty value for token %s is not allowed.", t.Name)
+		}
+		if len(t.Scopes) == 0 {
+			return fmt.Errorf("Set at least one scope for token %s.", t.Name)
+		}
+		for _, scope := range t.Scopes {
+			valid := false
+			for _, s := range validScopes {
+				if s == scope {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				return fmt.Errorf("Scope %s of token %s is not valid.", scope, t.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// findToken compares the given token with all the tokens in constant
+// time and returns the matching one. Values are hashed before comparing
+// so that their length is not leaked either.
+func findToken(tokens []*APIToken, token []byte) *APIToken {
+	var result *APIToken
+	hash := sha256.Sum256(token)
+	for _, t := range tokens {
+		h := sha256.Sum256([]byte(t.Token))
+		if subtle.ConstantTimeCompare(hash[:], h[:]) == 1 && result == nil {
+			result = t
+		}
+	}
+	return result
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+	"gopkg.in/yaml.v2"
+)
+
+func TestFindToken(t *testing.T) {
+	is := is.New(t)
+	tokens := []*APIToken{
+		{Name: "first", Token: "abc", Scopes: []string{ScopeUpload}},
+		{Name: "second", Token: "abcd", Scopes: []string{ScopeDelete}},
+	}
+	is.Equal(findToken(tokens, []byte("abc")), tokens[0])
+	is.Equal(findToken(tokens, []byte("abcd")), tokens[1])
+	is.True(findToken(tokens, []byte("ab")) == nil)
+	is.True(findToken(tokens, []byte("")) == nil)
+	is.True(findToken(nil, []byte("abc")) == nil)
+}
+
+func TestAPITokenHasScope(t *testing.T) {
+	is := is.New(t)
+	token := &APIToken{Scopes: []string{ScopeUpload, ScopeReadPrivate}}
+	is.True(token.hasScope(ScopeUpload))
+	is.True(token.hasScope(ScopeReadPrivate))
+	is.True(!token.hasScope(ScopeDelete))
+	is.True(newAdminToken("abc").hasScope(ScopeDelete))
+}
+
+func TestUnmarshalAPIToken(t *testing.T) {
+	is := is.New(t)
+	tokens := []*APIToken{}
+	err := yaml.Unmarshal([]byte(`
+- abc
+- name: backend
+  token: def
+  scopes: [upload]
+`), &tokens)
+	is.NoErr(err)
+	is.Equal(tokens, []*APIToken{
+		newAdminToken("abc"),
+		{Name: "backend", Token: "def", Scopes: []string{ScopeUpload}},
+	})
+}
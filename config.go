@@ -14,27 +14,63 @@ import (
 
 //Config is global configuration of the server
 type Config struct {
-	DataDir              string   `yaml:"data_directory"`
-	DefaultImageQuality  int      `yaml:"default_image_quality"`
-	ServerAddress        string   `yaml:"server_address"`
-	Token                string   `yaml:"token"`
-	ValidImageSizes      []string `yaml:"valid_image_sizes"`
-	ValidImageQualities  []int    `yaml:"valid_image_qualities"`
-	MaxUploadedImageSize int      `yaml:"max_uploaded_image_size"` // in megabytes
-	HTTPCacheTTL         int      `yaml:"http_cache_ttl"`
-	LogPath              string   `yaml:"log_path"`
-	Debug                bool     `yaml:"debug"`
-	ConvertConcurrency   int      `yaml:"convert_concurrency"`
+	DataDir              string          `yaml:"data_directory"`
+	DefaultImageQuality  int             `yaml:"default_image_quality"`
+	ServerAddress        string          `yaml:"server_address"`
+	UnixSocketMode       string          `yaml:"unix_socket_mode"`
+	TLSCertFile          string          `yaml:"tls_cert_file"`
+	TLSKeyFile           string          `yaml:"tls_key_file"`
+	Token                string          `yaml:"token"`
+	Tokens               []*APIToken     `yaml:"tokens"`
+	SigningKey           string          `yaml:"signing_key"`
+	ValidImageSizes      []string        `yaml:"valid_image_sizes"`
+	ValidImageQualities  []int           `yaml:"valid_image_qualities"`
+	MaxUploadedImageSize int             `yaml:"max_uploaded_image_size"` // in megabytes
+	MaxPixels            int             `yaml:"max_pixels"`
+	MaxImageDimension    int             `yaml:"max_image_dimension"`
+	NormalizeUploads     NormalizeConfig `yaml:"normalize_uploads"`
+	KeepVariantMetadata  MetadataOptions `yaml:"keep_variant_metadata"`
+	HTTPCacheTTL         int             `yaml:"http_cache_ttl"`
+	LogPath              string          `yaml:"log_path"`
+	LogLevel             string          `yaml:"log_level"`
+	LogFormat            string          `yaml:"log_format"`
+	AccessLog            bool            `yaml:"access_log"`
+	Debug                bool            `yaml:"debug"`
+	ConvertConcurrency   int             `yaml:"convert_concurrency"`
+	ReservedWorkers      int             `yaml:"reserved_interactive_workers"`
+	ConvertMemoryBudget  int             `yaml:"convert_memory_budget"` // in megabytes
+	ConvertTimeout       int             `yaml:"convert_timeout"`       // in seconds
+	MaxQueueLength       int             `yaml:"max_queue_length"`
+	FailedConversionTTL  int             `yaml:"failed_conversion_ttl"` // in seconds
+	QueueFullFallback    string          `yaml:"queue_full_fallback"`
+	MinFreeDiskSpace     int             `yaml:"min_free_disk_space"` // in megabytes
+	ShutdownTimeout      int             `yaml:"shutdown_timeout"`    // in seconds
+	Tenants              []*Tenant       `yaml:"tenants"`
+	RateLimit            RateLimitConfig `yaml:"rate_limit"`
+	HotlinkProtection    HotlinkConfig   `yaml:"hotlink_protection"`
+	CORS                 CORSConfig      `yaml:"cors"`
 }
 
 func getDefaultConfig() *Config {
 	return &Config{
 		DefaultImageQuality:  95,
 		ServerAddress:        "127.0.0.1:8080",
+		UnixSocketMode:       "0660",
 		ValidImageSizes:      []string{"300x300", "500x500"},
 		MaxUploadedImageSize: 4,
+		MaxPixels:            100000000,
+		MaxImageDimension:    30000,
 		HTTPCacheTTL:         2592000,
+		LogLevel:             "info",
+		LogFormat:            "text",
 		ConvertConcurrency:   runtime.NumCPU(),
+		ConvertTimeout:       30,
+		MaxQueueLength:       100,
+		FailedConversionTTL:  300,
+		QueueFullFallback:    FallbackNone,
+		MinFreeDiskSpace:     100,
+		ShutdownTimeout:      30,
+		HotlinkProtection:    HotlinkConfig{AllowEmptyReferer: true},
 	}
 
 }
@@ -49,8 +85,8 @@ func parseConfig(file io.Reader) (*Config, error) {
 		return nil, fmt.Errorf("Invalid Config File: %v", err)
 	}
 
-	if token := os.Getenv("WEBP_SERVER_TOKEN"); len(token) != 0 {
-		cfg.Token = token
+	if err := applyEnv(cfg); err != nil {
+		return nil, err
 	}
 
 	if cfg.DataDir == "" {
@@ -65,24 +101,146 @@ func parseConfig(file io.Reader) (*Config, error) {
 		return nil, fmt.Errorf("Absolute path for log_path needed but got: %s", cfg.LogPath)
 	}
 
+	if path, ok := unixSocketPath(cfg.ServerAddress); ok && !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("Absolute path for unix socket needed but got: %s", path)
+	}
+
+	if _, err := parseSocketMode(cfg.UnixSocketMode); err != nil {
+		return nil, err
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("Set both tls_cert_file and tls_key_file to enable TLS.")
+	}
+
+	if _, err := parseLevel(cfg.LogLevel); err != nil {
+		return nil, err
+	}
+
+	if err := validateLogFormat(cfg.LogFormat); err != nil {
+		return nil, err
+	}
+
 	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
 		return nil, fmt.Errorf("%+v\n", err)
 	}
 
-	sizePattern := regexp.MustCompile("([0-9]{1,4})x([0-9]{1,4})")
-	for _, size := range cfg.ValidImageSizes {
-		match := sizePattern.FindAllString(size, -1)
-		if len(match) != 1 {
-			return nil, fmt.Errorf("Image size %s is not valid. Try use WIDTHxHEIGHT format.", size)
-		}
+	if err := validateImageSizes(cfg.ValidImageSizes); err != nil {
+		return nil, err
 	}
 
 	if cfg.DefaultImageQuality < 10 || cfg.DefaultImageQuality > 100 {
 		return nil, fmt.Errorf("Default image quality should be 10 < q < 100.")
 	}
 
+	if cfg.MaxPixels < 0 {
+		return nil, fmt.Errorf("Max pixels should not be negative.")
+	}
+
+	if cfg.MaxImageDimension < 0 {
+		return nil, fmt.Errorf("Max image dimension should not be negative.")
+	}
+
+	if err := cfg.NormalizeUploads.validate(); err != nil {
+		return nil, err
+	}
+
 	if cfg.ConvertConcurrency <= 0 {
 		return nil, fmt.Errorf("Convert Concurrency should be greater than zero")
 	}
+
+	if cfg.ReservedWorkers < 0 || cfg.ReservedWorkers >= cfg.ConvertConcurrency {
+		return nil, fmt.Errorf("Reserved interactive workers should be 0 <= n < convert concurrency.")
+	}
+
+	if cfg.ConvertMemoryBudget < 0 {
+		return nil, fmt.Errorf("Convert memory budget should not be negative.")
+	}
+
+	if cfg.ConvertTimeout < 0 {
+		return nil, fmt.Errorf("Convert timeout should not be negative.")
+	}
+
+	if cfg.MaxQueueLength < 0 {
+		return nil, fmt.Errorf("Max queue length should not be negative.")
+	}
+
+	if cfg.FailedConversionTTL < 0 {
+		return nil, fmt.Errorf("Failed conversion ttl should not be negative.")
+	}
+
+	switch cfg.QueueFullFallback {
+	case FallbackNone, FallbackCachedVariant, FallbackOriginal:
+	default:
+		return nil, fmt.Errorf(
+			"Queue full fallback %s is not valid. Valid values are none, cached_variant and original.",
+			cfg.QueueFullFallback,
+		)
+	}
+
+	if cfg.MinFreeDiskSpace < 0 {
+		return nil, fmt.Errorf("Min free disk space should not be negative.")
+	}
+
+	if cfg.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("Shutdown timeout should not be negative.")
+	}
+
+	if err := validateTokens(cfg.Tokens); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.RateLimit.CacheHits.validate("cache_hits"); err != nil {
+		return nil, err
+	}
+	if err := cfg.RateLimit.Conversions.validate("conversions"); err != nil {
+		return nil, err
+	}
+	if _, err := parseNetworks(cfg.RateLimit.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.HotlinkProtection.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.CORS.validate(); err != nil {
+		return nil, err
+	}
+
+	tenantNames := make(map[string]bool)
+	for i, tenant := range cfg.Tenants {
+		if tenantNames[tenant.Name] {
+			return nil, fmt.Errorf("Tenant %s is defined more than once.", tenant.Name)
+		}
+		tenantNames[tenant.Name] = true
+		if err := tenant.setup(cfg); err != nil {
+			return nil, err
+		}
+		for _, other := range cfg.Tenants[:i] {
+			if tenant.overlaps(other) {
+				return nil, fmt.Errorf(
+					"Storage prefix %s of tenant %s overlaps with storage of tenant %s.",
+					tenant.StoragePrefix, tenant.Name, other.Name)
+			}
+		}
+		if err := validateImageSizes(tenant.ValidImageSizes); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(tenant.DataDir, 0755); err != nil {
+			return nil, fmt.Errorf("%+v\n", err)
+		}
+	}
 	return cfg, nil
 }
+
+func validateImageSizes(sizes []string) error {
+	sizePattern := regexp.MustCompile("([0-9]{1,4})x([0-9]{1,4})")
+	for _, size := range sizes {
+		match := sizePattern.FindAllString(size, -1)
+		if len(match) != 1 {
+			return fmt.Errorf("Image size %s is not valid. Try use WIDTHxHEIGHT format.", size)
+		}
+	}
+	return nil
+}
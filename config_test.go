@@ -47,13 +47,25 @@ convert_concurrency:
 		DataDir:              "/tmp/webp-server/",
 		DefaultImageQuality:  80,
 		ServerAddress:        "127.0.0.1:9000",
+		UnixSocketMode:       "0660",
 		Token:                "abcdefg",
 		ValidImageSizes:      []string{"200x200", "500x500", "600x600"},
 		ValidImageQualities:  []int{90, 95, 100},
 		MaxUploadedImageSize: 3,
+		MaxPixels:            100000000,
+		MaxImageDimension:    30000,
 		HTTPCacheTTL:         10,
 		Debug:                true,
+		LogLevel:             "info",
+		LogFormat:            "text",
 		ConvertConcurrency:   3,
+		ConvertTimeout:       30,
+		MaxQueueLength:       100,
+		FailedConversionTTL:  300,
+		QueueFullFallback:    "none",
+		MinFreeDiskSpace:     100,
+		ShutdownTimeout:      30,
+		HotlinkProtection:    HotlinkConfig{AllowEmptyReferer: true},
 	}
 
 	is.Equal(cfg, expected)
@@ -70,6 +82,54 @@ convert_concurrency:
 	is.Equal(cfg.Token, os.Getenv("WEBP_SERVER_TOKEN"))
 }
 
+func TestParseConfigTenants(t *testing.T) {
+	is := is.New(t)
+	configFile := strings.NewReader(`
+data_directory: /tmp/webp-server/
+valid_image_sizes: [300x300]
+valid_image_qualities: [90]
+max_uploaded_image_size: 3
+tenants:
+  - name: blog
+    tokens: [abc, def]
+  - name: shop
+    tokens:
+      - name: shop-backend
+        token: ghi
+        scopes: [upload, delete]
+    storage_prefix: shop-images
+    valid_image_sizes: [100x100]
+    valid_image_qualities: [80]
+    max_uploaded_image_size: 1
+    storage_quota: 100
+`)
+	defer os.RemoveAll("/tmp/webp-server")
+	cfg, err := parseConfig(configFile)
+	is.NoErr(err)
+	is.Equal(len(cfg.Tenants), 2)
+	is.Equal(cfg.Tenants[0], &Tenant{
+		Name:                 "blog",
+		Tokens:               []*APIToken{newAdminToken("abc"), newAdminToken("def")},
+		StoragePrefix:        "tenants/blog",
+		ValidImageSizes:      []string{"300x300"},
+		ValidImageQualities:  []int{90},
+		MaxUploadedImageSize: 3,
+		DataDir:              "/tmp/webp-server/tenants/blog",
+	})
+	is.Equal(cfg.Tenants[1], &Tenant{
+		Name:                 "shop",
+		Tokens:               []*APIToken{{Name: "shop-backend", Token: "ghi", Scopes: []string{"upload", "delete"}}},
+		StoragePrefix:        "shop-images",
+		ValidImageSizes:      []string{"100x100"},
+		ValidImageQualities:  []int{80},
+		MaxUploadedImageSize: 1,
+		StorageQuota:         100,
+		DataDir:              "/tmp/webp-server/shop-images",
+	})
+	_, err = os.Stat("/tmp/webp-server/shop-images")
+	is.NoErr(err)
+}
+
 func TestParseConfigErrors(t *testing.T) {
 	tt := []struct {
 		name string
@@ -106,11 +166,171 @@ func TestParseConfigErrors(t *testing.T) {
 			file: strings.NewReader("data_directory: /tmp/\ndefault_image_quality: 120"),
 			err:  fmt.Errorf("Default image quality should be 10 < q < 100."),
 		},
+		{
+			name: "negative_max_pixels",
+			file: strings.NewReader("data_directory: /tmp/\nmax_pixels: -1"),
+			err:  fmt.Errorf("Max pixels should not be negative."),
+		},
+		{
+			name: "negative_max_image_dimension",
+			file: strings.NewReader("data_directory: /tmp/\nmax_image_dimension: -1"),
+			err:  fmt.Errorf("Max image dimension should not be negative."),
+		},
+		{
+			name: "negative_normalize_max_dimension",
+			file: strings.NewReader("data_directory: /tmp/\nnormalize_uploads:\n  max_dimension: -1"),
+			err:  fmt.Errorf("Max dimension of normalize_uploads should not be negative."),
+		},
 		{
 			name: "invalid_convert_concurrency",
 			file: strings.NewReader("data_directory: /tmp/\nconvert_concurrency: 0"),
 			err:  fmt.Errorf("Convert Concurrency should be greater than zero"),
 		},
+		{
+			name: "reserved_workers_not_less_than_concurrency",
+			file: strings.NewReader("data_directory: /tmp/\nconvert_concurrency: 2\nreserved_interactive_workers: 2"),
+			err:  fmt.Errorf("Reserved interactive workers should be 0 <= n < convert concurrency."),
+		},
+		{
+			name: "negative_convert_memory_budget",
+			file: strings.NewReader("data_directory: /tmp/\nconvert_memory_budget: -1"),
+			err:  fmt.Errorf("Convert memory budget should not be negative."),
+		},
+		{
+			name: "negative_reserved_workers",
+			file: strings.NewReader("data_directory: /tmp/\nreserved_interactive_workers: -1"),
+			err:  fmt.Errorf("Reserved interactive workers should be 0 <= n < convert concurrency."),
+		},
+		{
+			name: "negative_rate_limit",
+			file: strings.NewReader("data_directory: /tmp/\nrate_limit:\n  cache_hits:\n    rate: -1"),
+			err:  fmt.Errorf("Rate of cache_hits rate limit should not be negative."),
+		},
+		{
+			name: "rate_limit_without_burst",
+			file: strings.NewReader("data_directory: /tmp/\nrate_limit:\n  conversions:\n    rate: 2"),
+			err:  fmt.Errorf("Burst of conversions rate limit should be greater than zero."),
+		},
+		{
+			name: "invalid_trusted_proxy",
+			file: strings.NewReader("data_directory: /tmp/\nrate_limit:\n  trusted_proxies: [localhost]"),
+			err:  fmt.Errorf("Trusted proxy localhost is not valid."),
+		},
+		{
+			name: "invalid_referer_pattern",
+			file: strings.NewReader("data_directory: /tmp/\nhotlink_protection:\n  allowed_referers: [example.*]"),
+			err:  fmt.Errorf("Referer pattern example.* is not valid. Try use example.com or *.example.com format."),
+		},
+		{
+			name: "non_absolute_placeholder",
+			file: strings.NewReader("data_directory: /tmp/\nhotlink_protection:\n  placeholder_image: ph.png"),
+			err:  fmt.Errorf("Absolute path for placeholder_image needed but got: ph.png"),
+		},
+		{
+			name: "relative_unix_socket",
+			file: strings.NewReader("data_directory: /tmp/\nserver_address: unix:webp.sock"),
+			err:  fmt.Errorf("Absolute path for unix socket needed but got: webp.sock"),
+		},
+		{
+			name: "invalid_unix_socket_mode",
+			file: strings.NewReader("data_directory: /tmp/\nunix_socket_mode: \"0999\""),
+			err:  fmt.Errorf("Unix socket mode 0999 is not valid. Try use 0660 format."),
+		},
+		{
+			name: "invalid_queue_full_fallback",
+			file: strings.NewReader("data_directory: /tmp/\nqueue_full_fallback: placeholder"),
+			err:  fmt.Errorf("Queue full fallback placeholder is not valid. Valid values are none, cached_variant and original."),
+		},
+		{
+			name: "negative_failed_conversion_ttl",
+			file: strings.NewReader("data_directory: /tmp/\nfailed_conversion_ttl: -1"),
+			err:  fmt.Errorf("Failed conversion ttl should not be negative."),
+		},
+		{
+			name: "invalid_log_level",
+			file: strings.NewReader("data_directory: /tmp/\nlog_level: verbose"),
+			err:  fmt.Errorf("Log level verbose is not valid. Valid levels are debug, info, warn and error."),
+		},
+		{
+			name: "invalid_log_format",
+			file: strings.NewReader("data_directory: /tmp/\nlog_format: xml"),
+			err:  fmt.Errorf("Log format xml is not valid. Valid formats are text, json and logfmt."),
+		},
+		{
+			name: "tls_key_without_cert",
+			file: strings.NewReader("data_directory: /tmp/\ntls_key_file: /etc/ssl/key.pem"),
+			err:  fmt.Errorf("Set both tls_cert_file and tls_key_file to enable TLS."),
+		},
+		{
+			name: "invalid_cors_origin",
+			file: strings.NewReader("data_directory: /tmp/\ncors:\n  allowed_origins: [example.com]"),
+			err:  fmt.Errorf("Origin example.com is not valid. Try use https://example.com format."),
+		},
+		{
+			name: "negative_cors_max_age",
+			file: strings.NewReader("data_directory: /tmp/\ncors:\n  max_age: -1"),
+			err:  fmt.Errorf("CORS max_age should not be negative."),
+		},
+		{
+			name: "invalid_tenant_name",
+			file: strings.NewReader("data_directory: /tmp/\ntenants:\n  - name: Blog\n    tokens: [abc]"),
+			err:  fmt.Errorf("Tenant name Blog is not valid. Use lowercase letters, digits, - and _."),
+		},
+		{
+			name: "reserved_tenant_name",
+			file: strings.NewReader("data_directory: /tmp/\ntenants:\n  - name: image\n    tokens: [abc]"),
+			err:  fmt.Errorf("Tenant name image is reserved."),
+		},
+		{
+			name: "duplicate_tenant",
+			file: strings.NewReader("data_directory: /tmp/\ntenants:\n  - name: blog\n    tokens: [abc]\n  - name: blog\n    tokens: [def]"),
+			err:  fmt.Errorf("Tenant blog is defined more than once."),
+		},
+		{
+			name: "tenant_without_token",
+			file: strings.NewReader("data_directory: /tmp/\ntenants:\n  - name: blog"),
+			err:  fmt.Errorf("Set at least one token for tenant blog."),
+		},
+		{
+			name: "empty_token",
+			file: strings.NewReader("data_directory: /tmp/\ntokens:\n  - name: backend\n    scopes: [upload]"),
+			err:  fmt.Errorf("Empty value for token backend is not allowed."),
+		},
+		{
+			name: "token_without_scope",
+			file: strings.NewReader("data_directory: /tmp/\ntokens:\n  - name: backend\n    token: abc"),
+			err:  fmt.Errorf("Set at least one scope for token backend."),
+		},
+		{
+			name: "invalid_token_scope",
+			file: strings.NewReader("data_directory: /tmp/\ntenants:\n  - name: blog\n    tokens:\n      - name: backend\n        token: abc\n        scopes: [read]"),
+			err:  fmt.Errorf("Scope read of token backend is not valid."),
+		},
+		{
+			name: "invalid_storage_prefix",
+			file: strings.NewReader("data_directory: /tmp/\ntenants:\n  - name: blog\n    tokens: [abc]\n    storage_prefix: ../blog"),
+			err:  fmt.Errorf("Storage prefix ../blog of tenant blog is not valid."),
+		},
+		{
+			name: "duplicate_storage_prefix",
+			file: strings.NewReader("data_directory: /tmp/\ntenants:\n  - name: blog\n    tokens: [abc]\n    storage_prefix: shared\n  - name: shop\n    tokens: [def]\n    storage_prefix: shared/"),
+			err:  fmt.Errorf("Storage prefix shared/ of tenant shop overlaps with storage of tenant blog."),
+		},
+		{
+			name: "nested_storage_prefix",
+			file: strings.NewReader("data_directory: /tmp/\ntenants:\n  - name: blog\n    tokens: [abc]\n  - name: shop\n    tokens: [def]\n    storage_prefix: tenants/blog/images"),
+			err:  fmt.Errorf("Storage prefix tenants/blog/images of tenant shop overlaps with storage of tenant blog."),
+		},
+		{
+			name: "parent_storage_prefix",
+			file: strings.NewReader("data_directory: /tmp/\ntenants:\n  - name: blog\n    tokens: [abc]\n  - name: shop\n    tokens: [def]\n    storage_prefix: tenants"),
+			err:  fmt.Errorf("Storage prefix tenants of tenant shop overlaps with storage of tenant blog."),
+		},
+		{
+			name: "invalid_tenant_image_size",
+			file: strings.NewReader("data_directory: /tmp/\ntenants:\n  - name: blog\n    tokens: [abc]\n    valid_image_sizes: [300x]"),
+			err:  fmt.Errorf("Image size 300x is not valid. Try use WIDTHxHEIGHT format."),
+		},
 	}
 
 	for _, tc := range tt {
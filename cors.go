@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "DELETE"}
+	defaultCORSHeaders = []string{"Token", "Content-Type"}
+)
+
+//CORSConfig holds the cross-origin resource sharing settings.
+//CORS headers are only set when AllowedOrigins is not empty.
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	AllowedMethods []string `yaml:"allowed_methods"`
+	AllowedHeaders []string `yaml:"allowed_headers"`
+	MaxAge         int      `yaml:"max_age"` // in seconds
+}
+
+func (cc *CORSConfig) validate() error {
+	for _, origin := range cc.AllowedOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("Origin %s is not valid. Try use https://example.com format.", origin)
+		}
+	}
+	if cc.MaxAge < 0 {
+		return fmt.Errorf("CORS max_age should not be negative.")
+	}
+	return nil
+}
+
+func (cc *CORSConfig) originIsAllowed(origin string) bool {
+	for _, o := range cc.AllowedOrigins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc *CORSConfig) allowMethods() string {
+	if len(cc.AllowedMethods) == 0 {
+		return strings.Join(defaultCORSMethods, ", ")
+	}
+	return strings.ToUpper(strings.Join(cc.AllowedMethods, ", "))
+}
+
+func (cc *CORSConfig) allowHeaders() string {
+	if len(cc.AllowedHeaders) == 0 {
+		return strings.Join(defaultCORSHeaders, ", ")
+	}
+	return strings.Join(cc.AllowedHeaders, ", ")
+}
+
+func (cc *CORSConfig) maxAge() string {
+	return strconv.Itoa(cc.MaxAge)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestOriginIsAllowed(t *testing.T) {
+	is := is.New(t)
+	cc := &CORSConfig{AllowedOrigins: []string{"https://example.com/"}}
+	is.True(cc.originIsAllowed("https://example.com"))
+	is.True(cc.originIsAllowed("https://EXAMPLE.com"))
+	is.True(!cc.originIsAllowed("http://example.com"))
+	is.True(!cc.originIsAllowed("https://www.example.com"))
+
+	cc.AllowedOrigins = []string{"*"}
+	is.True(cc.originIsAllowed("https://other.com"))
+}
+
+func TestCORSHeaderValues(t *testing.T) {
+	is := is.New(t)
+	cc := &CORSConfig{}
+	is.Equal(cc.allowMethods(), "GET, POST, PUT, DELETE")
+	is.Equal(cc.allowHeaders(), "Token, Content-Type")
+
+	cc.AllowedMethods = []string{"get", "post"}
+	cc.AllowedHeaders = []string{"Token", "X-Requested-With"}
+	is.Equal(cc.allowMethods(), "GET, POST")
+	is.Equal(cc.allowHeaders(), "Token, X-Requested-With")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/jpeg" // registers jpeg for image.DecodeConfig
+	_ "image/png"  // registers png for image.DecodeConfig
+	"io"
+	"io/ioutil"
+	"os"
+
+	bimg "gopkg.in/h2non/bimg.v1"
+)
+
+// webpHeaderSize is the number of bytes which contain the
+// dimensions of all kinds of webp files.
+const webpHeaderSize = 30
+
+//ImageLimits restricts the dimensions of images for protecting
+//the server against decompression bombs. Zero values mean unlimited.
+type ImageLimits struct {
+	MaxPixels    int
+	MaxDimension int
+}
+
+// enabled reports whether any of the limits is set.
+func (limits ImageLimits) enabled() bool {
+	return limits.MaxPixels > 0 || limits.MaxDimension > 0
+}
+
+func (limits ImageLimits) check(width, height int) error {
+	if limits.MaxDimension > 0 && (width > limits.MaxDimension || height > limits.MaxDimension) {
+		return fmt.Errorf(
+			"Image dimensions %dx%d exceed the maximum of %d pixels per side.",
+			width, height, limits.MaxDimension)
+	}
+	if limits.MaxPixels > 0 && int64(width)*int64(height) > int64(limits.MaxPixels) {
+		return fmt.Errorf(
+			"Image dimensions %dx%d exceed the maximum of %d pixels.",
+			width, height, limits.MaxPixels)
+	}
+	return nil
+}
+
+// readImageSize reads the width and height of a jpeg, png or webp
+// image from its header without decoding the pixels.
+func readImageSize(r io.Reader) (int, int, error) {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(webpHeaderSize)
+	if len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WEBP" {
+		return readWebpSize(header)
+	}
+	config, _, err := image.DecodeConfig(br)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not read dimensions of image: %v", err)
+	}
+	return config.Width, config.Height, nil
+}
+
+// readWebpSize parses the first chunk of webp files which is
+// VP8 for lossy, VP8L for lossless and VP8X for extended format.
+func readWebpSize(header []byte) (int, int, error) {
+	if len(header) < webpHeaderSize {
+		return 0, 0, fmt.Errorf("Could not read dimensions of image: webp header is too short")
+	}
+	data := header[20:]
+	switch string(header[12:16]) {
+	case "VP8 ":
+		if data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+			return 0, 0, fmt.Errorf("Could not read dimensions of image: invalid VP8 start code")
+		}
+		width := int(binary.LittleEndian.Uint16(data[6:8]) & 0x3fff)
+		height := int(binary.LittleEndian.Uint16(data[8:10]) & 0x3fff)
+		return width, height, nil
+	case "VP8L":
+		if data[0] != 0x2f {
+			return 0, 0, fmt.Errorf("Could not read dimensions of image: invalid VP8L signature")
+		}
+		bits := binary.LittleEndian.Uint32(data[1:5])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	case "VP8X":
+		width := int(data[4]) | int(data[5])<<8 | int(data[6])<<16
+		height := int(data[7]) | int(data[8])<<8 | int(data[9])<<16
+		return width + 1, height + 1, nil
+	}
+	return 0, 0, fmt.Errorf("Could not read dimensions of image: unknown webp chunk %q", header[12:16])
+}
+
+// readImageBufferSize reads the width and height of the image from its
+// header and falls back to libvips for images whose header can not be
+// parsed, like lossless or arithmetic coded jpeg files. libvips only
+// reads the header too and does not decode the pixels.
+func readImageBufferSize(buf []byte) (int, int, error) {
+	width, height, err := readImageSize(bytes.NewReader(buf))
+	if err == nil {
+		return width, height, nil
+	}
+	size, vipsErr := bimg.NewImage(buf).Size()
+	if vipsErr != nil {
+		return 0, 0, err
+	}
+	return size.Width, size.Height, nil
+}
+
+// readImageFileSize reads the width and height of the image file like
+// readImageBufferSize. The whole file is only read for libvips when its
+// header can not be parsed.
+func readImageFileSize(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	width, height, err := readImageSize(f)
+	if err == nil {
+		return width, height, nil
+	}
+	if _, seekErr := f.Seek(0, io.SeekStart); seekErr != nil {
+		return 0, 0, err
+	}
+	buf, readErr := ioutil.ReadAll(f)
+	if readErr != nil {
+		return 0, 0, err
+	}
+	return readImageBufferSize(buf)
+}
+
+// estimateConvertMemory returns the estimated number of bytes which
+// libvips needs for converting an image with the given dimensions.
+// Decoded pixels take 4 bytes in RGBA and processing may keep another
+// copy of them.
+func estimateConvertMemory(width, height int) int64 {
+	return int64(width) * int64(height) * 4 * 2
+}
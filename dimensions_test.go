@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func webpHeader(chunk string, data ...byte) []byte {
+	header := append([]byte("RIFF\x00\x00\x00\x00WEBP"+chunk+"\x00\x00\x00\x00"), data...)
+	return append(header, make([]byte, webpHeaderSize)...)
+}
+
+func TestReadImageSize(t *testing.T) {
+	testCases := []struct {
+		name   string
+		path   string
+		data   []byte
+		width  int
+		height int
+		err    error
+	}{
+		{name: "jpeg", path: testFileJPEG, width: 1680, height: 1050},
+		{name: "png", path: testFilePNG, width: 1680, height: 1050},
+		{name: "webp_lossy", path: testFileWEBP, width: 550, height: 368},
+		{name: "png_bomb", path: testFileBomb, width: 50000, height: 50000},
+		{
+			name: "webp_lossless",
+			// 1000x600 packed in 14 bits each
+			data:  webpHeader("VP8L", 0x2f, 0xe7, 0xc3, 0x95, 0x00),
+			width: 1000, height: 600,
+		},
+		{
+			name:  "webp_extended",
+			data:  webpHeader("VP8X", 0, 0, 0, 0, 0x4f, 0xc3, 0x00, 0x3f, 0x9c, 0x00),
+			width: 50000, height: 40000,
+		},
+		{
+			name: "webp_invalid_start_code",
+			data: webpHeader("VP8 ", 0, 0, 0, 0, 0, 0),
+			err:  fmt.Errorf("Could not read dimensions of image: invalid VP8 start code"),
+		},
+		{
+			name: "pdf",
+			path: testFilePDF,
+			err:  fmt.Errorf("Could not read dimensions of image: image: unknown format"),
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			var width, height int
+			var err error
+			if tc.path != "" {
+				width, height, err = readImageFileSize(tc.path)
+			} else {
+				width, height, err = readImageSize(bytes.NewReader(tc.data))
+			}
+			is.Equal(err, tc.err)
+			is.Equal(width, tc.width)
+			is.Equal(height, tc.height)
+		})
+	}
+}
+
+// arithmeticJPEG is the header of a 200x100 arithmetic coded jpeg
+// (SOF9) which can not be parsed by image/jpeg.
+var arithmeticJPEG = []byte{
+	0xff, 0xd8, 0xff, 0xc9, 0x00, 0x11, 0x08, 0x00, 0x64, 0x00, 0xc8, 0x03,
+	0x01, 0x11, 0x00, 0x02, 0x11, 0x00, 0x03, 0x11, 0x00, 0xff, 0xd9,
+}
+
+func TestReadImageBufferSize(t *testing.T) {
+	is := is.New(t)
+	buf, err := ioutil.ReadFile(testFileJPEG)
+	is.NoErr(err)
+	width, height, err := readImageBufferSize(buf)
+	is.NoErr(err)
+	is.Equal([]int{width, height}, []int{1680, 1050})
+
+	// libvips reads the images which image package does not support
+	_, _, err = readImageSize(bytes.NewReader(arithmeticJPEG))
+	is.True(err != nil)
+	width, height, err = readImageBufferSize(arithmeticJPEG)
+	is.NoErr(err)
+	is.Equal([]int{width, height}, []int{200, 100})
+
+	f, err := ioutil.TempFile("", "arithmetic")
+	is.NoErr(err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(arithmeticJPEG)
+	is.NoErr(err)
+	is.NoErr(f.Close())
+	width, height, err = readImageFileSize(f.Name())
+	is.NoErr(err)
+	is.Equal([]int{width, height}, []int{200, 100})
+
+	_, _, err = readImageBufferSize([]byte("not an image"))
+	is.Equal(err, fmt.Errorf("Could not read dimensions of image: image: unknown format"))
+}
+
+func TestImageLimits(t *testing.T) {
+	testCases := []struct {
+		name   string
+		limits ImageLimits
+		width  int
+		height int
+		err    error
+	}{
+		{name: "unlimited", width: 50000, height: 50000},
+		{name: "allowed", limits: ImageLimits{MaxPixels: 1000000, MaxDimension: 2000}, width: 2000, height: 500},
+		{
+			name:   "too_many_pixels",
+			limits: ImageLimits{MaxPixels: 1000000, MaxDimension: 2000},
+			width:  1001, height: 1000,
+			err: fmt.Errorf("Image dimensions 1001x1000 exceed the maximum of 1000000 pixels."),
+		},
+		{
+			name:   "too_wide",
+			limits: ImageLimits{MaxPixels: 1000000, MaxDimension: 2000},
+			width:  2001, height: 10,
+			err: fmt.Errorf("Image dimensions 2001x10 exceed the maximum of 2000 pixels per side."),
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(tc.limits.check(tc.width, tc.height), tc.err)
+			is.Equal(tc.limits.enabled(), tc.name != "unlimited")
+		})
+	}
+}
+
+func TestEstimateConvertMemory(t *testing.T) {
+	is := is.New(t)
+	is.Equal(estimateConvertMemory(1000, 500), int64(4000000))
+	// does not overflow for huge images
+	is.Equal(estimateConvertMemory(50000, 50000), int64(20000000000))
+}
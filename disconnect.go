@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// disconnectCheckInterval is how often the connections of
+// clients which wait for conversions are checked.
+const disconnectCheckInterval = 100 * time.Millisecond
+
+// convertContext returns the context which limits waiting for
+// conversions of the request to the convert timeout. It is also
+// cancelled when the client closes the connection, so that queued
+// conversions which nobody waits for are removed. fasthttp does not
+// report client disconnects to handlers, so the connection is checked
+// periodically. cancel should be called before the handler returns.
+func convertContext(ctx *fasthttp.RequestCtx, config *Config) (context.Context, context.CancelFunc) {
+	var taskCtx context.Context
+	var cancel context.CancelFunc
+	if config.ConvertTimeout > 0 {
+		taskCtx, cancel = context.WithTimeout(context.Background(), time.Duration(config.ConvertTimeout)*time.Second)
+	} else {
+		taskCtx, cancel = context.WithCancel(context.Background())
+	}
+
+	// connection is taken before the handler returns and
+	// the request context is reused for other requests
+	conn := ctx.Conn()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(disconnectCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-taskCtx.Done():
+				return
+			case <-ticker.C:
+				if connClosed(conn) {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return taskCtx, func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// connClosed reports whether the peer has closed the connection. The
+// socket is peeked without blocking, so that the data of pipelined
+// requests is not consumed. Connections which are not backed by a
+// socket, like tls connections, are never reported as closed.
+func connClosed(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	closed := false
+	raw.Read(func(fd uintptr) bool {
+		buf := make([]byte, 1)
+		n, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		closed = n == 0 && err == nil
+		return true
+	})
+	return closed
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// waitFor polls the condition until it is true or the test times out.
+func waitFor(is *is.I, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		is.True(time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnClosed(t *testing.T) {
+	is := is.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	is.NoErr(err)
+	conn, err := ln.Accept()
+	is.NoErr(err)
+	defer conn.Close()
+	is.True(!connClosed(conn))
+
+	// pending data is not consumed
+	_, err = client.Write([]byte("GET"))
+	is.NoErr(err)
+	is.True(!connClosed(conn))
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(conn, buf)
+	is.NoErr(err)
+	is.Equal(string(buf), "GET")
+
+	is.NoErr(client.Close())
+	waitFor(is, func() bool { return connClosed(conn) })
+}
+
+func TestClientDisconnectCancelsQueuedConversion(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.ConvertConcurrency = 1
+	handler := newHandler(config)
+	server := handler.createServer()
+	defer os.RemoveAll(config.DataDir)
+
+	uploadResp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	release, started := make(chan struct{}), make(chan struct{}, 2)
+	convertFunction = func(inputPath, outputPath string, params *ImageParams) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	defer func() { convertFunction = convert }()
+
+	// the only worker is busy with the first conversion
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		uri := fmt.Sprintf("http://test/image/w=500,h=500/%s", uploadResult.ImageID)
+		serve(server, createRequest(uri, "GET", nil, nil))
+	}()
+	<-started
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	is.NoErr(err)
+	_, err = fmt.Fprintf(conn, "GET /image/w=100,h=100/%s HTTP/1.1\r\nHost: test\r\n\r\n", uploadResult.ImageID)
+	is.NoErr(err)
+	waitFor(is, func() bool { return handler.TaskManager.QueueLength() == 1 })
+
+	is.NoErr(conn.Close())
+	waitFor(is, func() bool { return handler.TaskManager.QueueLength() == 0 })
+
+	close(release)
+	wg.Wait()
+	is.Equal(len(started), 0) // the cancelled conversion never started
+}
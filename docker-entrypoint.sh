@@ -2,12 +2,21 @@
 
 set -e
 
-if [ -z "$TOKEN" ]; then
-    echo "TOKEN env variable must be defined."
-    exit 1
-else
+if [ -n "$TOKEN" ]; then
     export WEBP_SERVER_TOKEN="$TOKEN";
 fi
 
-set -- webp-server -config /var/lib/webp-server/config.yml
+if [ -z "$WEBP_SERVER_TOKEN" ]; then
+    echo "TOKEN or WEBP_SERVER_TOKEN env variable must be defined."
+    exit 1
+fi
+
+CONFIG_PATH="${WEBP_SERVER_CONFIG:-/var/lib/webp-server/config.yml}"
+
+if [ -f "$CONFIG_PATH" ]; then
+    set -- webp-server -config "$CONFIG_PATH"
+else
+    # config is read from WEBP_SERVER_* env variables
+    set -- webp-server
+fi
 exec "$@"
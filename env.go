@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix is the prefix of environment variables which override config
+const envPrefix = "WEBP_SERVER_"
+
+// applyEnv overrides the config fields by the environment variables.
+// Name of each variable is the upper-cased yaml key of the field and
+// keys of nested fields are joined by underscore,
+// e.g. WEBP_SERVER_RATE_LIMIT_CACHE_HITS_RATE.
+func applyEnv(cfg *Config) error {
+	return applyEnvToStruct(reflect.ValueOf(cfg).Elem(), envPrefix)
+}
+
+func applyEnvToStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvToStruct(field, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(field, value); err != nil {
+			return fmt.Errorf("Invalid value for %s environment variable: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func isScalarKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// setFromEnv sets the value of field from the environment variable.
+// Strings are used as is and lists of scalars are comma separated.
+// Other values, like lists of tenants, are parsed as yaml.
+func setFromEnv(field reflect.Value, value string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	if field.Kind() == reflect.Slice && isScalarKind(field.Type().Elem().Kind()) {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		slice := reflect.MakeSlice(field.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setFromEnv(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+	return yaml.UnmarshalStrict([]byte(value), field.Addr().Interface())
+}
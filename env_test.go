@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func setEnv(t *testing.T, env map[string]string) func() {
+	for key, value := range env {
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for key := range env {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestParseConfigFromEnv(t *testing.T) {
+	is := is.New(t)
+	defer setEnv(t, map[string]string{
+		"WEBP_SERVER_DATA_DIRECTORY":                         "/tmp/webp-server-env/",
+		"WEBP_SERVER_SERVER_ADDRESS":                         "0.0.0.0:8080",
+		"WEBP_SERVER_TOKEN":                                  "abc: def",
+		"WEBP_SERVER_VALID_IMAGE_SIZES":                      "300x300, 800x600",
+		"WEBP_SERVER_VALID_IMAGE_QUALITIES":                  "80,90",
+		"WEBP_SERVER_MAX_UPLOADED_IMAGE_SIZE":                "8",
+		"WEBP_SERVER_DEBUG":                                  "true",
+		"WEBP_SERVER_RATE_LIMIT_CACHE_HITS_RATE":             "2.5",
+		"WEBP_SERVER_RATE_LIMIT_CACHE_HITS_BURST":            "10",
+		"WEBP_SERVER_RATE_LIMIT_TRUSTED_PROXIES":             "10.0.0.0/8",
+		"WEBP_SERVER_HOTLINK_PROTECTION_ALLOW_EMPTY_REFERER": "false",
+		"WEBP_SERVER_TOKENS":                                 "[{name: ci, token: ci-token, scopes: [upload]}]",
+	})()
+	defer os.RemoveAll("/tmp/webp-server-env/")
+
+	cfg, err := parseConfig(strings.NewReader("valid_image_sizes: [100x100]\nhttp_cache_ttl: 10"))
+	is.NoErr(err)
+	is.Equal(cfg.DataDir, "/tmp/webp-server-env/")
+	is.Equal(cfg.ServerAddress, "0.0.0.0:8080")
+	is.Equal(cfg.Token, "abc: def")
+	is.Equal(cfg.ValidImageSizes, []string{"300x300", "800x600"})
+	is.Equal(cfg.ValidImageQualities, []int{80, 90})
+	is.Equal(cfg.MaxUploadedImageSize, 8)
+	is.Equal(cfg.HTTPCacheTTL, 10)
+	is.True(cfg.Debug)
+	is.Equal(cfg.RateLimit.CacheHits, RateLimit{Rate: 2.5, Burst: 10})
+	is.Equal(cfg.RateLimit.TrustedProxies, []string{"10.0.0.0/8"})
+	is.True(!cfg.HotlinkProtection.AllowEmptyReferer)
+	is.Equal(cfg.Tokens, []*APIToken{{Name: "ci", Token: "ci-token", Scopes: []string{ScopeUpload}}})
+}
+
+func TestParseConfigInvalidEnv(t *testing.T) {
+	tt := []struct {
+		key   string
+		value string
+	}{
+		{"WEBP_SERVER_VALID_IMAGE_QUALITIES", "80,high"},
+		{"WEBP_SERVER_DEBUG", "sometimes"},
+		{"WEBP_SERVER_RATE_LIMIT_CONVERSIONS_BURST", "ten"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.key, func(t *testing.T) {
+			is := is.NewRelaxed(t)
+			defer setEnv(t, map[string]string{tc.key: tc.value})()
+			_, err := parseConfig(strings.NewReader("data_directory: /tmp/"))
+			is.True(err != nil)
+			is.True(strings.HasPrefix(err.Error(), fmt.Sprintf("Invalid value for %s environment variable: ", tc.key)))
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type failure struct {
+	reason  string
+	expires time.Time
+}
+
+//FailureCache remembers the conversions which have failed, keyed by
+//their cache keys, so that broken images are not decoded by libvips
+//on every request.
+type FailureCache struct {
+	failures    map[string]*failure
+	lastCleanup time.Time
+	sync.Mutex
+}
+
+//NewFailureCache creates an empty failure cache
+func NewFailureCache() *FailureCache {
+	return &FailureCache{
+		failures:    make(map[string]*failure),
+		lastCleanup: time.Now(),
+	}
+}
+
+// Get returns the reason of the failure of key if it has not expired.
+func (fc *FailureCache) Get(key string, now time.Time) (string, bool) {
+	fc.Lock()
+	defer fc.Unlock()
+	f, ok := fc.failures[key]
+	if !ok || !now.Before(f.expires) {
+		return "", false
+	}
+	return f.reason, true
+}
+
+// Add remembers the failure of key for ttl.
+func (fc *FailureCache) Add(key string, reason string, ttl time.Duration, now time.Time) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.cleanup(now)
+	fc.failures[key] = &failure{reason: reason, expires: now.Add(ttl)}
+}
+
+// cleanup removes the expired failures.
+func (fc *FailureCache) cleanup(now time.Time) {
+	if now.Sub(fc.lastCleanup) < time.Minute {
+		return
+	}
+	fc.lastCleanup = now
+	for key, f := range fc.failures {
+		if !now.Before(f.expires) {
+			delete(fc.failures, key)
+		}
+	}
+}
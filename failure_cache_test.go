@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestFailureCache(t *testing.T) {
+	is := is.New(t)
+	fc := NewFailureCache()
+	now := time.Now()
+
+	_, ok := fc.Get("key", now)
+	is.True(!ok)
+
+	fc.Add("key", "Corrupt image", time.Minute, now)
+	reason, ok := fc.Get("key", now.Add(30*time.Second))
+	is.True(ok)
+	is.Equal(reason, "Corrupt image")
+
+	_, ok = fc.Get("key", now.Add(time.Minute))
+	is.True(!ok)
+	is.Equal(len(fc.failures), 1)
+
+	// expired failures are removed on next additions
+	fc.Add("other", "Corrupt image", time.Minute, now.Add(2*time.Minute))
+	is.Equal(len(fc.failures), 1)
+	_, ok = fc.Get("other", now.Add(2*time.Minute))
+	is.True(ok)
+}
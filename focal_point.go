@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	bimg "gopkg.in/h2non/bimg.v1"
+)
+
+//FocalPoint is the most important point of an image which fit=cover
+//crops are centred on. X and Y are fractions of the width and height
+//of the image from its top left corner between 0 and 1.
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+func (fp *FocalPoint) validate() error {
+	if fp.X < 0 || fp.X > 1 || fp.Y < 0 || fp.Y > 1 {
+		return fmt.Errorf("Focal point should be between 0 and 1.")
+	}
+	return nil
+}
+
+//FocalPointUpdate sets the focal point of an image
+//or removes it when it is null in info update requests.
+type FocalPointUpdate struct {
+	Set   bool
+	Value *FocalPoint
+}
+
+//UnmarshalJSON is called for null values too
+//which is not the case for pointer fields.
+func (u *FocalPointUpdate) UnmarshalJSON(data []byte) error {
+	u.Set = true
+	u.Value = nil
+	if string(data) == "null" {
+		return nil
+	}
+	fp := &FocalPoint{}
+	if err := json.Unmarshal(data, fp); err != nil {
+		return err
+	}
+	if err := fp.validate(); err != nil {
+		return err
+	}
+	u.Value = fp
+	return nil
+}
+
+// clampInt limits val to the [min, max] range
+func clampInt(val, min, max int) int {
+	if val < min {
+		return min
+	}
+	if val > max {
+		return max
+	}
+	return val
+}
+
+// setFocalPointCrop makes libvips resize the image to cover the requested
+// size and then extract the requested area around the focal point instead
+// of cropping it by gravity. size is the size of image after being rotated
+// according to its EXIF orientation.
+func (params *ImageParams) setFocalPointCrop(options *bimg.Options, size *bimg.ImageSize) {
+	width, height := params.Width, params.Height
+	scale := math.Max(
+		float64(width)/float64(size.Width),
+		float64(height)/float64(size.Height),
+	)
+	if size.Width < width && size.Height < height {
+		// like cropping by gravity, images are not enlarged
+		// when both of their sides are smaller than requested
+		scale = 1
+		width, height = size.Width, size.Height
+	}
+	scaledWidth := int(math.Max(math.Round(float64(size.Width)*scale), float64(width)))
+	scaledHeight := int(math.Max(math.Round(float64(size.Height)*scale), float64(height)))
+
+	options.Crop = false
+	options.Embed = false
+	options.Force = true
+	options.Width = scaledWidth
+	options.Height = scaledHeight
+	options.AreaWidth = width
+	options.AreaHeight = height
+	options.Left = clampInt(
+		int(math.Round(params.FocalPoint.X*float64(scaledWidth)))-width/2,
+		0, scaledWidth-width,
+	)
+	options.Top = clampInt(
+		int(math.Round(params.FocalPoint.Y*float64(scaledHeight)))-height/2,
+		0, scaledHeight-height,
+	)
+}
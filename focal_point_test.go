@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matryer/is"
+	bimg "gopkg.in/h2non/bimg.v1"
+)
+
+func TestFocalPointUpdate(t *testing.T) {
+	tt := []struct {
+		name     string
+		body     string
+		expected FocalPointUpdate
+		valid    bool
+	}{
+		{"omitted", `{}`, FocalPointUpdate{}, true},
+		{"null", `{"focal_point": null}`, FocalPointUpdate{Set: true}, true},
+		{
+			"set", `{"focal_point": {"x": 0.25, "y": 1}}`,
+			FocalPointUpdate{Set: true, Value: &FocalPoint{X: 0.25, Y: 1}}, true,
+		},
+		{"out_of_range", `{"focal_point": {"x": 1.5, "y": 0.5}}`, FocalPointUpdate{}, false},
+		{"negative", `{"focal_point": {"x": 0.5, "y": -0.1}}`, FocalPointUpdate{}, false},
+		{"invalid", `{"focal_point": "center"}`, FocalPointUpdate{}, false},
+	}
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			update := &ImageInfoUpdate{}
+			err := json.Unmarshal([]byte(tc.body), update)
+			if !tc.valid {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(update.FocalPoint, tc.expected)
+		})
+	}
+}
+
+func TestFocalPointCrop(t *testing.T) {
+	tt := []struct {
+		name       string
+		width      int
+		height     int
+		focalPoint FocalPoint
+		size       bimg.ImageSize
+		expected   [6]int // width, height, area width, area height, left, top
+	}{
+		{"landscape_centre", 300, 300, FocalPoint{0.5, 0.5}, bimg.ImageSize{Width: 900, Height: 600}, [6]int{450, 300, 300, 300, 75, 0}},
+		{"landscape_left", 300, 300, FocalPoint{0.1, 0.5}, bimg.ImageSize{Width: 900, Height: 600}, [6]int{450, 300, 300, 300, 0, 0}},
+		{"landscape_right", 300, 300, FocalPoint{0.7, 0.9}, bimg.ImageSize{Width: 900, Height: 600}, [6]int{450, 300, 300, 300, 150, 0}},
+		{"landscape_edge", 300, 300, FocalPoint{1, 1}, bimg.ImageSize{Width: 900, Height: 600}, [6]int{450, 300, 300, 300, 150, 0}},
+		{"portrait_top", 400, 200, FocalPoint{0.5, 0.2}, bimg.ImageSize{Width: 800, Height: 1200}, [6]int{400, 600, 400, 200, 0, 20}},
+		{"enlarged", 300, 100, FocalPoint{0.5, 0.8}, bimg.ImageSize{Width: 200, Height: 200}, [6]int{300, 300, 300, 100, 0, 190}},
+		{"not_enlarged", 300, 300, FocalPoint{0.5, 0.5}, bimg.ImageSize{Width: 200, Height: 100}, [6]int{200, 100, 200, 100, 0, 0}},
+	}
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			params := &ImageParams{
+				Width:      tc.width,
+				Height:     tc.height,
+				Fit:        FitCover,
+				FocalPoint: &tc.focalPoint,
+			}
+			options := params.toBimgOptions(&tc.size)
+			is.True(!options.Crop && !options.Embed && options.Force)
+			is.Equal(
+				[6]int{options.Width, options.Height, options.AreaWidth, options.AreaHeight, options.Left, options.Top},
+				tc.expected,
+			)
+		})
+	}
+}
+
+func TestFocalPointUsage(t *testing.T) {
+	is := is.New(t)
+	size := &bimg.ImageSize{Width: 900, Height: 600}
+	params := &ImageParams{ImageID: "NG4uQBa2f", Width: 300, Height: 300, Fit: FitCover}
+	withoutFocalPoint := params.getMd5()
+
+	params.FocalPoint = &FocalPoint{X: 0.2, Y: 0.3}
+	withFocalPoint := params.getMd5()
+	is.True(withFocalPoint != withoutFocalPoint)
+	is.True(params.toBimgOptions(size).Force)
+
+	params.FocalPoint = &FocalPoint{X: 0.3, Y: 0.3}
+	is.True(params.getMd5() != withFocalPoint)
+
+	// gravity of the request takes precedence
+	params.Gravity = GravityNorth
+	options := params.toBimgOptions(size)
+	is.True(options.Crop && !options.Force)
+
+	// other fits ignore the focal point and keep their caches
+	params = &ImageParams{ImageID: "NG4uQBa2f", Width: 300, Height: 300, Fit: FitContain}
+	contain := params.getMd5()
+	params.FocalPoint = &FocalPoint{X: 0.2, Y: 0.3}
+	is.Equal(params.getMd5(), contain)
+	is.True(!params.toBimgOptions(size).Force)
+}
@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/teris-io/shortid"
@@ -21,47 +27,167 @@ var (
 	PathUpload = []byte("/upload/")
 	PathImage  = []byte("/image/")
 	PathDelete = []byte("/delete/")
+	PathInfo   = []byte("/info/")
+	PathList   = []byte("/list/")
+	PathReady  = []byte("/ready/")
 
-	ImageRegex  = regexp.MustCompile("/image/((?P<options>[0-9a-z,=-]+)/)?(?P<imageID>[0-9a-zA-Z_-]{9,12})$")
-	DeleteRegex = regexp.MustCompile("/delete/(?P<imageID>[0-9a-zA-Z_-]{9,12})$")
+	PathSignUpload = []byte("/sign/upload/")
+	PathSignImage  = []byte("/sign/image/")
 
-	CacheControlKey = []byte("Cache-Control")
+	ImageRegex   = regexp.MustCompile("/image/((?P<options>[0-9a-z,=-]+)/)?(?P<imageID>[0-9a-zA-Z_-]{9,12})$")
+	DeleteRegex  = regexp.MustCompile("/delete/(?P<imageID>[0-9a-zA-Z_-]{9,12})$")
+	InfoRegex    = regexp.MustCompile("/info/(?P<imageID>[0-9a-zA-Z_-]{9,12})$")
+	ImageIDRegex = regexp.MustCompile("^[0-9a-zA-Z_-]{9,12}$")
+
+	CacheControlKey     = []byte("Cache-Control")
+	PrivateCacheControl = []byte("private, no-store")
+
+	// Values of queue_full_fallback config
+	FallbackNone          = "none"
+	FallbackCachedVariant = "cached_variant"
+	FallbackOriginal      = "original"
 
 	ErrorMethodNotAllowed = []byte(`{"error": "Method not allowed"}`)
 	ErrorImageNotProvided = []byte(`{"error": "image_file field not provided"}`)
 	ErrorFileIsNotImage   = []byte(`{"error": "Provided file is not an accepted image"}`)
 	ErrorInvalidToken     = []byte(`{"error": "Invalid Token"}`)
+	ErrorPermissionDenied = []byte(`{"error": "Token does not have permission for this operation"}`)
 	ErrorImageNotFound    = []byte(`{"error": "Image not found"}`)
 	ErrorAddressNotFound  = []byte(`{"error": "Address not found"}`)
 	ErrorServerError      = []byte(`{"error": "Internal Server Error"}`)
+	ErrorInvalidMetadata  = []byte(`{"error": "metadata should be a json object of strings"}`)
+	ErrorInvalidInfo      = []byte(`{"error": "Invalid info body"}`)
+	ErrorImageTooLarge    = []byte(`{"error": "Image is too large"}`)
+	ErrorQuotaExceeded    = []byte(`{"error": "Storage quota exceeded"}`)
+	ErrorFormatNotAllowed = []byte(`{"error": "Image format is not allowed"}`)
+	ErrorSigningDisabled  = []byte(`{"error": "signing_key is not set in server config"}`)
+	ErrorImageIsPrivate   = []byte(`{"error": "Image is private"}`)
+	ErrorPrivateDisabled  = []byte(`{"error": "Private images need a token in server config"}`)
+	ErrorTooManyRequests  = []byte(`{"error": "Too many requests"}`)
+	ErrorHotlinkForbidden = []byte(`{"error": "Embedding images from this site is not allowed"}`)
+	ErrorOriginNotAllowed = []byte(`{"error": "Origin is not allowed"}`)
+	ErrorShuttingDown     = []byte(`{"error": "Server is shutting down"}`)
+	ErrorConvertTimeout   = []byte(`{"error": "Image conversion timed out"}`)
+	ErrorConvertCancelled = []byte(`{"error": "Image conversion cancelled"}`)
+	ErrorQueueFull        = []byte(`{"error": "Server is busy converting other images"}`)
+
+	// Key of the request user value which holds name of the authorized token
+	TokenNameKey = "token_name"
+
+	// Key of the request user value which tells if the image is served from cache
+	CacheStatusKey = "cache_status"
 
 	// This variable makes us be able to mock convert function in tests
 	convertFunction = convert
 )
 
 type Handler struct {
+	current      atomic.Value // *Settings
+	TaskManager  *TaskManager
+	StorageUsage *StorageUsage
+	Failures     *FailureCache
+	VipsChecker  *VipsChecker
+}
+
+//Settings is the part of handler which is derived from config.
+//It is replaced as a whole when config is reloaded.
+type Settings struct {
 	Config             *Config
 	CacheControlHeader []byte
-	TaskManager        *TaskManager
+	DefaultTenant      *Tenant
+	Tenants            map[string]*Tenant
+	CacheHitLimiter    *RateLimiter
+	ConversionLimiter  *RateLimiter
+	TrustedProxies     []*net.IPNet
 }
 
-func createServer(config *Config) *fasthttp.Server {
-	handler := &Handler{Config: config}
+func newSettings(config *Config) (*Settings, error) {
+	settings := &Settings{
+		Config:            config,
+		DefaultTenant:     newDefaultTenant(config),
+		Tenants:           make(map[string]*Tenant),
+		CacheHitLimiter:   NewRateLimiter(config.RateLimit.CacheHits),
+		ConversionLimiter: NewRateLimiter(config.RateLimit.Conversions),
+	}
+	trustedProxies, err := parseNetworks(config.RateLimit.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	settings.TrustedProxies = trustedProxies
+	for _, tenant := range config.Tenants {
+		settings.Tenants[tenant.Name] = tenant
+	}
 	if config.HTTPCacheTTL == 0 {
-		handler.CacheControlHeader = []byte("private, no-cache, no-store, must-revalidate")
+		settings.CacheControlHeader = []byte("private, no-cache, no-store, must-revalidate")
 	} else {
-		handler.CacheControlHeader = []byte(fmt.Sprintf("max-age=%d", config.HTTPCacheTTL))
+		settings.CacheControlHeader = []byte(fmt.Sprintf("max-age=%d", config.HTTPCacheTTL))
+	}
+	return settings, nil
+}
+
+func newHandler(config *Config) *Handler {
+	handler := &Handler{
+		StorageUsage: NewStorageUsage(),
+		Failures:     NewFailureCache(),
+		VipsChecker:  &VipsChecker{},
+		TaskManager:  NewTaskManager(config.ConvertConcurrency, config.ReservedWorkers, config.MaxQueueLength),
+	}
+	if err := handler.Reload(config); err != nil {
+		panic(err)
 	}
-	handler.TaskManager = NewTaskManager(config.ConvertConcurrency)
+	return handler
+}
+
+func (handler *Handler) settings() *Settings {
+	return handler.current.Load().(*Settings)
+}
+
+func (handler *Handler) config() *Config {
+	return handler.settings().Config
+}
+
+// Reload replaces the settings of handler with the ones derived from
+// the given config. Requests which are being processed keep using the
+// previous settings.
+func (handler *Handler) Reload(config *Config) error {
+	settings, err := newSettings(config)
+	if err != nil {
+		return err
+	}
+	handler.current.Store(settings)
+	handler.TaskManager.SetMaxQueueLength(config.MaxQueueLength)
+	handler.TaskManager.SetMemoryBudget(int64(config.ConvertMemoryBudget) * 1024 * 1024)
+	// quotas may have been changed
+	handler.StorageUsage.Reset()
+	return nil
+}
+
+// maxRequestBodySize returns the largest upload size of all the tenants
+func maxRequestBodySize(config *Config) int {
+	maxUploadedImageSize := config.MaxUploadedImageSize
+	for _, tenant := range config.Tenants {
+		if tenant.MaxUploadedImageSize > maxUploadedImageSize {
+			maxUploadedImageSize = tenant.MaxUploadedImageSize
+		}
+	}
+	return maxUploadedImageSize * 1024 * 1024
+}
+
+func (handler *Handler) createServer() *fasthttp.Server {
 	return &fasthttp.Server{
 		Handler:               handler.handleRequests,
 		ErrorHandler:          handler.handleErrors,
 		NoDefaultServerHeader: true,
-		MaxRequestBodySize:    config.MaxUploadedImageSize * 1024 * 1024,
+		MaxRequestBodySize:    maxRequestBodySize(handler.config()),
 		ReadTimeout:           time.Duration(5 * time.Second),
+		Logger:                logger,
 	}
 }
 
+func createServer(config *Config) *fasthttp.Server {
+	return newHandler(config).createServer()
+}
+
 func jsonResponse(ctx *fasthttp.RequestCtx, status int, body []byte) {
 	ctx.SetStatusCode(status)
 	ctx.SetContentType("application/json")
@@ -76,42 +202,182 @@ func handlePanic(ctx *fasthttp.RequestCtx) {
 	if err := recover(); err != nil {
 		ctx.ResetBody()
 		jsonResponse(ctx, 500, ErrorServerError)
-		log.Println(err)
+		logger.Error("Request failed", "path", string(ctx.Path()), "error", err)
 	}
 }
 
 // router function
 func (handler *Handler) handleRequests(ctx *fasthttp.RequestCtx) {
+	if handler.config().AccessLog {
+		defer handler.logAccess(ctx, time.Now())
+	}
 	defer handlePanic(ctx)
 
-	path := ctx.Path()
+	if preflight := handler.handleCORS(ctx); preflight {
+		return
+	}
+
+	tenant, path := handler.resolveTenant(ctx.Path())
 
 	if bytes.HasPrefix(path, PathImage) {
-		handler.handleFetch(ctx)
+		handler.handleFetch(ctx, tenant)
 	} else if bytes.Equal(path, PathUpload) {
-		handler.handleUpload(ctx)
+		handler.handleUpload(ctx, tenant)
 	} else if bytes.HasPrefix(path, PathDelete) {
-		handler.handleDelete(ctx)
+		handler.handleDelete(ctx, tenant)
+	} else if bytes.HasPrefix(path, PathInfo) {
+		handler.handleInfo(ctx, tenant)
+	} else if bytes.Equal(path, PathList) {
+		handler.handleList(ctx, tenant)
+	} else if bytes.Equal(path, PathSignUpload) {
+		handler.handleSignUpload(ctx, tenant)
+	} else if bytes.HasPrefix(path, PathSignImage) {
+		handler.handleSignImage(ctx, tenant, path)
 	} else if bytes.Equal(path, PathHealth) {
 		jsonResponse(ctx, 200, []byte(`{"status": "ok"}`))
+	} else if bytes.Equal(path, PathReady) {
+		handler.handleReady(ctx)
 	} else {
 		jsonResponse(ctx, 404, ErrorAddressNotFound)
 	}
 }
 
-func (handler *Handler) tokenIsValid(ctx *fasthttp.RequestCtx) bool {
-	return len(handler.Config.Token) == 0 ||
-		handler.Config.Token == string(ctx.Request.Header.Peek("Token"))
+// handleCORS sets CORS headers for the requests coming from allowed
+// origins and responds to preflight requests. It returns true if the
+// request was a preflight request and has been responded.
+func (handler *Handler) handleCORS(ctx *fasthttp.RequestCtx) bool {
+	cors := &handler.config().CORS
+	origin := ctx.Request.Header.Peek("Origin")
+	if len(cors.AllowedOrigins) == 0 || len(origin) == 0 {
+		return false
+	}
+	preflight := ctx.IsOptions() && len(ctx.Request.Header.Peek("Access-Control-Request-Method")) != 0
+
+	ctx.Response.Header.Add("Vary", "Origin")
+	if !cors.originIsAllowed(string(origin)) {
+		if preflight {
+			jsonResponse(ctx, 403, ErrorOriginNotAllowed)
+		}
+		return preflight
+	}
+	ctx.Response.Header.SetBytesV("Access-Control-Allow-Origin", origin)
+
+	if preflight {
+		ctx.Response.Header.Set("Access-Control-Allow-Methods", cors.allowMethods())
+		ctx.Response.Header.Set("Access-Control-Allow-Headers", cors.allowHeaders())
+		if cors.MaxAge > 0 {
+			ctx.Response.Header.Set("Access-Control-Max-Age", cors.maxAge())
+		}
+		ctx.SetStatusCode(204)
+	}
+	return preflight
+}
+
+// resolveTenant finds the tenant from the first segment of the path
+// and returns the rest of the path. Requests without tenant prefix
+// belong to the default tenant.
+func (handler *Handler) resolveTenant(path []byte) (*Tenant, []byte) {
+	settings := handler.settings()
+	if len(settings.Tenants) != 0 && len(path) > 1 {
+		if i := bytes.IndexByte(path[1:], '/'); i > 0 {
+			if tenant, ok := settings.Tenants[string(path[1:i+1])]; ok {
+				return tenant, path[i+1:]
+			}
+		}
+	}
+	return settings.DefaultTenant, path
+}
+
+// authorize checks the Token header against the tokens of the tenant
+// and writes the error response if the token is not valid or does not
+// have the required scope. Tenants without tokens accept any request.
+func (handler *Handler) authorize(ctx *fasthttp.RequestCtx, tenant *Tenant, scope string) bool {
+	if len(tenant.Tokens) == 0 {
+		ctx.SetUserValue(TokenNameKey, "anonymous")
+		return true
+	}
+	token := findToken(tenant.Tokens, ctx.Request.Header.Peek("Token"))
+	if token == nil {
+		jsonResponse(ctx, 401, ErrorInvalidToken)
+		return false
+	}
+	if !token.hasScope(scope) {
+		jsonResponse(ctx, 403, ErrorPermissionDenied)
+		return false
+	}
+	ctx.SetUserValue(TokenNameKey, token.Name)
+	return true
 }
 
-func (handler *Handler) handleUpload(ctx *fasthttp.RequestCtx) {
+// canReadPrivate reports whether the request has a valid signature
+// or a token with read-private scope for fetching private images.
+func (handler *Handler) canReadPrivate(ctx *fasthttp.RequestCtx, tenant *Tenant) bool {
+	if len(ctx.QueryArgs().Peek("signature")) != 0 {
+		err := verifyImageSignature(handler.config().SigningKey, string(ctx.Path()), ctx.QueryArgs(), time.Now())
+		return err == nil
+	}
+	token := findToken(tenant.Tokens, ctx.Request.Header.Peek("Token"))
+	return token != nil && token.hasScope(ScopeReadPrivate)
+}
+
+// allowRequest takes a token from the client's bucket of the limiter
+// and writes 429 response if the client has exceeded its budget.
+func (handler *Handler) allowRequest(ctx *fasthttp.RequestCtx, limiter *RateLimiter) bool {
+	if limiter == nil {
+		return true
+	}
+	allowed, wait := limiter.Allow(clientIP(ctx, handler.settings().TrustedProxies), time.Now())
+	if !allowed {
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(retryAfter))
+		jsonResponse(ctx, 429, ErrorTooManyRequests)
+	}
+	return allowed
+}
+
+// logAccess writes the access log entry of the request
+func (handler *Handler) logAccess(ctx *fasthttp.RequestCtx, start time.Time) {
+	duration := time.Since(start)
+	logger.Info(
+		"Request",
+		"method", string(ctx.Method()),
+		"path", string(ctx.Path()),
+		"status", ctx.Response.StatusCode(),
+		"bytes", len(ctx.Response.Body()),
+		"duration_ms", math.Round(duration.Seconds()*1e6)/1e3,
+		"cache", cacheStatus(ctx),
+		"client_ip", clientIP(ctx, handler.settings().TrustedProxies),
+		"token", tokenName(ctx),
+	)
+}
+
+func cacheStatus(ctx *fasthttp.RequestCtx) string {
+	status, _ := ctx.UserValue(CacheStatusKey).(string)
+	return status
+}
+
+func tokenName(ctx *fasthttp.RequestCtx) string {
+	name, _ := ctx.UserValue(TokenNameKey).(string)
+	return name
+}
+
+func (handler *Handler) handleUpload(ctx *fasthttp.RequestCtx, tenant *Tenant) {
 	if !ctx.IsPost() {
 		jsonResponse(ctx, 405, ErrorMethodNotAllowed)
 		return
 	}
 
-	if !handler.tokenIsValid(ctx) {
-		jsonResponse(ctx, 401, ErrorInvalidToken)
+	// pre-signed upload urls are used instead of token
+	policy := &UploadPolicy{}
+	if len(ctx.QueryArgs().Peek("signature")) != 0 {
+		var err error
+		policy, err = parseUploadPolicy(handler.config().SigningKey, string(ctx.Path()), ctx.QueryArgs(), time.Now())
+		if err != nil {
+			jsonResponse(ctx, 401, []byte(fmt.Sprintf(`{"error": "%v"}`, err)))
+			return
+		}
+		ctx.SetUserValue(TokenNameKey, "pre-signed url")
+	} else if !handler.authorize(ctx, tenant, ScopeUpload) {
 		return
 	}
 
@@ -120,30 +386,244 @@ func (handler *Handler) handleUpload(ctx *fasthttp.RequestCtx) {
 		jsonResponse(ctx, 400, ErrorImageNotProvided)
 		return
 	}
-	if imageValidated := validateImage(fileHeader); !imageValidated {
+	format := detectImageFormat(fileHeader)
+	if format == "" {
 		jsonResponse(ctx, 400, ErrorFileIsNotImage)
 		return
 	}
+	if !policy.allowsFormat(format) {
+		jsonResponse(ctx, 400, ErrorFormatNotAllowed)
+		return
+	}
+	if fileHeader.Size > int64(tenant.MaxUploadedImageSize)*1024*1024 ||
+		(policy.MaxSize != 0 && fileHeader.Size > policy.MaxSize) {
+		jsonResponse(ctx, 413, ErrorImageTooLarge)
+		return
+	}
+	config := handler.config()
+	limits := ImageLimits{MaxPixels: config.MaxPixels, MaxDimension: config.MaxImageDimension}
+	if err := validateImageDimensions(fileHeader, limits); err != nil {
+		errorBody := []byte(fmt.Sprintf(`{"error": "%v"}`, err))
+		jsonResponse(ctx, 400, errorBody)
+		return
+	}
 
 	imageID := shortid.GetDefault().MustGenerate()
-	imagePath := getFilePathFromImageID(handler.Config.DataDir, imageID)
+	info := newImageInfo(imageID)
+	if metadata := ctx.FormValue("metadata"); len(metadata) != 0 {
+		if err := json.Unmarshal(metadata, &info.Metadata); err != nil || info.Metadata == nil {
+			jsonResponse(ctx, 400, ErrorInvalidMetadata)
+			return
+		}
+	}
+	info.Tags = parseTags(string(ctx.FormValue("tags")))
+	info.Private = string(ctx.FormValue("private")) == "true"
+	if info.Private && !tenant.allowsPrivateImages() {
+		jsonResponse(ctx, 400, ErrorPrivateDisabled)
+		return
+	}
+
+	var normalized []byte
+	size := fileHeader.Size
+	normalize := &config.NormalizeUploads
+	if normalize.Enabled {
+		var ok bool
+		if normalized, ok = handler.normalizeUpload(ctx, fileHeader, tenant.imageName(imageID), config); !ok {
+			return
+		}
+		size = int64(len(normalized))
+		if normalize.KeepOriginal {
+			size += fileHeader.Size
+		}
+	}
+
+	reserved, err := handler.StorageUsage.Reserve(tenant, size)
+	if err != nil {
+		panic(err)
+	}
+	if !reserved {
+		jsonResponse(ctx, 413, ErrorQuotaExceeded)
+		return
+	}
+
+	imagePath := getFilePathFromImageID(tenant.DataDir, imageID)
 	if err := os.MkdirAll(filepath.Dir(imagePath), 0755); err != nil {
+		handler.StorageUsage.Release(tenant, size)
 		panic(err)
 	}
-	if err := fasthttp.SaveMultipartFile(fileHeader, imagePath); err != nil {
+	if normalized == nil {
+		err = fasthttp.SaveMultipartFile(fileHeader, imagePath)
+	} else {
+		err = ioutil.WriteFile(imagePath, normalized, 0644)
+		if err == nil && normalize.KeepOriginal {
+			err = fasthttp.SaveMultipartFile(fileHeader, getOriginalPathFromImageID(tenant.DataDir, imageID))
+		}
+	}
+	if err != nil {
+		os.Remove(imagePath)
+		handler.StorageUsage.Release(tenant, size)
 		panic(err)
 	}
+	if len(info.Metadata) != 0 || len(info.Tags) != 0 || info.Private {
+		if err := writeImageInfo(tenant.DataDir, info); err != nil {
+			panic(err)
+		}
+	}
+	logger.Info("Image uploaded", "image", tenant.imageName(imageID), "token", tokenName(ctx))
 	jsonResponse(ctx, 200, []byte(fmt.Sprintf(`{"image_id": "%s"}`, imageID)))
 }
 
-func (handler *Handler) handleDelete(ctx *fasthttp.RequestCtx) {
+// normalizeUpload processes the uploaded image by the task manager,
+// so that it is limited like conversions. It returns false if the
+// image could not be processed and the response is written.
+func (handler *Handler) normalizeUpload(
+	ctx *fasthttp.RequestCtx,
+	fileHeader *multipart.FileHeader,
+	imageName string,
+	config *Config,
+) ([]byte, bool) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		panic(err)
+	}
+	original, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	var cost int64
+	if width, height, err := readImageSize(bytes.NewReader(original)); err == nil {
+		cost = estimateConvertMemory(width, height)
+	}
+	taskCtx, cancel := convertContext(ctx, config)
+	defer cancel()
+	var normalized []byte
+	err = handler.TaskManager.RunTask(taskCtx, "upload:"+imageName, cost, func() error {
+		result, err := normalizeFunction(original, &config.NormalizeUploads)
+		normalized = result
+		return err
+	})
+	if err == nil {
+		return normalized, true
+	}
+	if isConversionFailure(err) {
+		logger.Error("Image normalization failed", "image", imageName, "error", err)
+		conversionFailedResponse(ctx, err.Error())
+		return nil, false
+	}
+	if taskErrorResponse(ctx, err) {
+		return nil, false
+	}
+	panic(err)
+}
+
+// handleSignUpload creates a short-lived signed upload url which can
+// be given to browsers for uploading images directly without token.
+func (handler *Handler) handleSignUpload(ctx *fasthttp.RequestCtx, tenant *Tenant) {
+	if !ctx.IsPost() {
+		jsonResponse(ctx, 405, ErrorMethodNotAllowed)
+		return
+	}
+
+	if !handler.authorize(ctx, tenant, ScopeUpload) {
+		return
+	}
+
+	if len(handler.config().SigningKey) == 0 {
+		jsonResponse(ctx, 501, ErrorSigningDisabled)
+		return
+	}
+
+	expiresIn, maxSize := 300, 0
+	var err error
+	if val := ctx.FormValue("expires_in"); len(val) != 0 {
+		if expiresIn, err = strconv.Atoi(string(val)); err != nil || expiresIn <= 0 || expiresIn > 86400 {
+			jsonResponse(ctx, 400, []byte(`{"error": "expires_in should be between 1 and 86400 seconds"}`))
+			return
+		}
+	}
+	if val := ctx.FormValue("max_size"); len(val) != 0 {
+		if maxSize, err = strconv.Atoi(string(val)); err != nil || maxSize < 0 {
+			jsonResponse(ctx, 400, []byte(`{"error": "max_size should be a positive integer"}`))
+			return
+		}
+	}
+	policy := &UploadPolicy{
+		Expires: time.Now().Unix() + int64(expiresIn),
+		MaxSize: int64(maxSize),
+		Formats: parseTags(string(ctx.FormValue("formats"))),
+	}
+	if err := validateUploadFormats(policy.Formats); err != nil {
+		jsonResponse(ctx, 400, []byte(fmt.Sprintf(`{"error": "%v"}`, err)))
+		return
+	}
+
+	uploadPath := tenant.pathPrefix() + string(PathUpload)
+	body, err := json.Marshal(map[string]interface{}{
+		"upload_url": signUploadURL(handler.config().SigningKey, uploadPath, policy),
+		"expires":    policy.Expires,
+	})
+	if err != nil {
+		panic(err)
+	}
+	jsonResponse(ctx, 200, body)
+}
+
+// handleSignImage creates a short-lived signed url for
+// fetching a private image or one of its variants.
+func (handler *Handler) handleSignImage(ctx *fasthttp.RequestCtx, tenant *Tenant, path []byte) {
+	if !ctx.IsGet() && !ctx.IsPost() {
+		jsonResponse(ctx, 405, ErrorMethodNotAllowed)
+		return
+	}
+
+	if !handler.authorize(ctx, tenant, ScopeReadPrivate) {
+		return
+	}
+
+	if len(handler.config().SigningKey) == 0 {
+		jsonResponse(ctx, 501, ErrorSigningDisabled)
+		return
+	}
+
+	if !tenant.allowsPrivateImages() {
+		jsonResponse(ctx, 501, ErrorPrivateDisabled)
+		return
+	}
+
+	imagePath := path[len("/sign"):]
+	if _, imageID := parseImageURI(imagePath); len(imageID) == 0 {
+		jsonResponse(ctx, 404, ErrorAddressNotFound)
+		return
+	}
+
+	expiresIn := 300
+	if val := ctx.FormValue("expires_in"); len(val) != 0 {
+		var err error
+		if expiresIn, err = strconv.Atoi(string(val)); err != nil || expiresIn <= 0 || expiresIn > 86400 {
+			jsonResponse(ctx, 400, []byte(`{"error": "expires_in should be between 1 and 86400 seconds"}`))
+			return
+		}
+	}
+	expires := time.Now().Unix() + int64(expiresIn)
+	body, err := json.Marshal(map[string]interface{}{
+		"url":     signImageURL(handler.config().SigningKey, tenant.pathPrefix()+string(imagePath), expires),
+		"expires": expires,
+	})
+	if err != nil {
+		panic(err)
+	}
+	jsonResponse(ctx, 200, body)
+}
+
+func (handler *Handler) handleDelete(ctx *fasthttp.RequestCtx, tenant *Tenant) {
 	if !ctx.IsDelete() {
 		jsonResponse(ctx, 405, ErrorMethodNotAllowed)
 		return
 	}
 
-	if !handler.tokenIsValid(ctx) {
-		jsonResponse(ctx, 401, ErrorInvalidToken)
+	if !handler.authorize(ctx, tenant, ScopeDelete) {
 		return
 	}
 
@@ -153,9 +633,12 @@ func (handler *Handler) handleDelete(ctx *fasthttp.RequestCtx) {
 		return
 	}
 	imageID := string(match[1])
-	imagePath := getFilePathFromImageID(handler.Config.DataDir, imageID)
+	imagePath := getFilePathFromImageID(tenant.DataDir, imageID)
 
-	err := os.Remove(imagePath)
+	fi, err := os.Stat(imagePath)
+	if err == nil {
+		err = os.Remove(imagePath)
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			jsonResponse(ctx, 404, ErrorImageNotFound)
@@ -163,23 +646,184 @@ func (handler *Handler) handleDelete(ctx *fasthttp.RequestCtx) {
 		}
 		panic(err)
 	}
+	handler.StorageUsage.Release(tenant, fi.Size())
+	originalPath := getOriginalPathFromImageID(tenant.DataDir, imageID)
+	if fi, err := os.Stat(originalPath); err == nil {
+		if err := os.Remove(originalPath); err != nil {
+			panic(err)
+		}
+		handler.StorageUsage.Release(tenant, fi.Size())
+	}
+	logger.Info("Image deleted", "image", tenant.imageName(imageID), "token", tokenName(ctx))
+	infoPath := getInfoPathFromImageID(tenant.DataDir, imageID)
+	if err := os.Remove(infoPath); err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
 	jsonResponse(ctx, 204, nil)
 }
 
-func (handler *Handler) handleFetch(ctx *fasthttp.RequestCtx) {
+func (handler *Handler) handleInfo(ctx *fasthttp.RequestCtx, tenant *Tenant) {
+	if !ctx.IsGet() && !ctx.IsPut() {
+		jsonResponse(ctx, 405, ErrorMethodNotAllowed)
+		return
+	}
+
+	scope := ScopeReadPrivate
+	if ctx.IsPut() {
+		scope = ScopeUpload
+	}
+	if !handler.authorize(ctx, tenant, scope) {
+		return
+	}
+
+	match := InfoRegex.FindSubmatch(ctx.Path())
+	if len(match) != 2 {
+		jsonResponse(ctx, 404, ErrorAddressNotFound)
+		return
+	}
+	imageID := string(match[1])
+	imagePath := getFilePathFromImageID(tenant.DataDir, imageID)
+	if _, err := os.Stat(imagePath); err != nil {
+		if os.IsNotExist(err) {
+			jsonResponse(ctx, 404, ErrorImageNotFound)
+			return
+		}
+		panic(err)
+	}
+
+	info, err := readImageInfo(tenant.DataDir, imageID)
+	if err != nil {
+		panic(err)
+	}
+
+	if ctx.IsPut() {
+		infoUpdate := &ImageInfoUpdate{}
+		if err := json.Unmarshal(ctx.PostBody(), infoUpdate); err != nil {
+			jsonResponse(ctx, 400, ErrorInvalidInfo)
+			return
+		}
+		if infoUpdate.Private != nil && *infoUpdate.Private && !tenant.allowsPrivateImages() {
+			jsonResponse(ctx, 400, ErrorPrivateDisabled)
+			return
+		}
+		info.update(infoUpdate)
+		if err := writeImageInfo(tenant.DataDir, info); err != nil {
+			panic(err)
+		}
+		logger.Info("Image info updated", "image", tenant.imageName(imageID), "token", tokenName(ctx))
+	}
+
+	body, err := json.Marshal(info)
+	if err != nil {
+		panic(err)
+	}
+	jsonResponse(ctx, 200, body)
+}
+
+// handleList returns a page of info of the images filtered by query
+// arguments. tag argument can be repeated, limit and after paginate
+// the list and other arguments are matched against metadata values.
+func (handler *Handler) handleList(ctx *fasthttp.RequestCtx, tenant *Tenant) {
 	if !ctx.IsGet() {
 		jsonResponse(ctx, 405, ErrorMethodNotAllowed)
 		return
 	}
+
+	if !handler.authorize(ctx, tenant, ScopeReadPrivate) {
+		return
+	}
+
+	limit := defaultListLimit
+	if val := ctx.QueryArgs().Peek("limit"); len(val) != 0 {
+		var err error
+		if limit, err = strconv.Atoi(string(val)); err != nil || limit <= 0 || limit > maxListLimit {
+			jsonResponse(ctx, 400, []byte(fmt.Sprintf(`{"error": "limit should be between 1 and %d"}`, maxListLimit)))
+			return
+		}
+	}
+
+	tags := []string{}
+	metadata := map[string]string{}
+	ctx.QueryArgs().VisitAll(func(key, value []byte) {
+		switch string(key) {
+		case "tag":
+			tags = append(tags, string(value))
+		case "limit", "after":
+		default:
+			metadata[string(key)] = string(value)
+		}
+	})
+
+	list, err := listImageInfos(tenant.DataDir, tags, metadata, string(ctx.QueryArgs().Peek("after")), limit)
+	if err != nil {
+		panic(err)
+	}
+	body, err := json.Marshal(list)
+	if err != nil {
+		panic(err)
+	}
+	jsonResponse(ctx, 200, body)
+}
+
+func (handler *Handler) handleReady(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		jsonResponse(ctx, 405, ErrorMethodNotAllowed)
+		return
+	}
+	report := handler.checkReadiness()
+	body, err := json.Marshal(report)
+	if err != nil {
+		panic(err)
+	}
+	if report.Status != checkOK {
+		logger.Warn("Readiness check failed", "report", string(body))
+		jsonResponse(ctx, 503, body)
+		return
+	}
+	jsonResponse(ctx, 200, body)
+}
+
+func (handler *Handler) handleFetch(ctx *fasthttp.RequestCtx, tenant *Tenant) {
+	if !ctx.IsGet() {
+		jsonResponse(ctx, 405, ErrorMethodNotAllowed)
+		return
+	}
+	settings := handler.settings()
+	hotlink := &settings.Config.HotlinkProtection
+	referer, origin := ctx.Request.Header.Peek("Referer"), ctx.Request.Header.Peek("Origin")
+	if !hotlink.refererIsAllowed(string(referer), string(origin)) {
+		if hotlink.PlaceholderImage != "" && handler.serveFileFromDisk(ctx, hotlink.PlaceholderImage, true) {
+			ctx.Response.Header.SetBytesKV(CacheControlKey, PrivateCacheControl)
+			return
+		}
+		jsonResponse(ctx, 403, ErrorHotlinkForbidden)
+		return
+	}
+
 	options, imageID := parseImageURI(ctx.Path())
 	if len(imageID) == 0 {
 		jsonResponse(ctx, 404, ErrorAddressNotFound)
 		return
 	}
 
+	info, err := readImageInfo(tenant.DataDir, imageID)
+	if err != nil {
+		panic(err)
+	}
+	if info.Private {
+		if !handler.canReadPrivate(ctx, tenant) {
+			jsonResponse(ctx, 403, ErrorImageIsPrivate)
+			return
+		}
+		defer ctx.Response.Header.SetBytesKV(CacheControlKey, PrivateCacheControl)
+	}
+
 	if len(options) == 0 {
 		// user wants original file
-		imagePath := getFilePathFromImageID(handler.Config.DataDir, imageID)
+		if !handler.allowRequest(ctx, settings.CacheHitLimiter) {
+			return
+		}
+		imagePath := getFilePathFromImageID(tenant.DataDir, imageID)
 		if ok := handler.serveFileFromDisk(ctx, imagePath, true); !ok {
 			jsonResponse(ctx, 404, ErrorImageNotFound)
 		}
@@ -192,7 +836,7 @@ func (handler *Handler) handleFetch(ctx *fasthttp.RequestCtx) {
 		imageID,
 		options,
 		webpAccepted,
-		handler.Config,
+		settings.Config,
 	)
 
 	if err != nil {
@@ -200,6 +844,8 @@ func (handler *Handler) handleFetch(ctx *fasthttp.RequestCtx) {
 		jsonResponse(ctx, 400, errorBody)
 		return
 	}
+	imageParams.Tenant = tenant.Name
+	imageParams.FocalPoint = info.FocalPoint
 
 	if webpAccepted {
 		ctx.SetContentType("image/webp")
@@ -207,30 +853,90 @@ func (handler *Handler) handleFetch(ctx *fasthttp.RequestCtx) {
 		ctx.SetContentType("image/jpeg")
 	}
 
-	cacheFilePath := imageParams.getCachePath(handler.Config.DataDir)
-	if ok := handler.serveFileFromDisk(ctx, cacheFilePath, false); ok {
-		// request served from cache
-		return
+	cacheFilePath := imageParams.getCachePath(tenant.DataDir)
+	if _, err := os.Stat(cacheFilePath); err == nil {
+		if !handler.allowRequest(ctx, settings.CacheHitLimiter) {
+			return
+		}
+		if ok := handler.serveFileFromDisk(ctx, cacheFilePath, false); ok {
+			// request served from cache
+			ctx.SetUserValue(CacheStatusKey, "hit")
+			return
+		}
 	}
 	// cache didn't exist
 
-	if err := validateImageParams(imageParams, handler.Config); err != nil {
+	if err := validateImageParams(imageParams, tenant, settings.Config); err != nil {
 		errorBody := []byte(fmt.Sprintf(`{"error": "%v"}`, err))
 		jsonResponse(ctx, 400, errorBody)
 		return
 	}
 
-	imagePath := getFilePathFromImageID(handler.Config.DataDir, imageParams.ImageID)
+	ctx.SetUserValue(CacheStatusKey, "miss")
 
-	err = handler.TaskManager.RunTask(imageParams.getMd5(), func() error {
-		return convertFunction(imagePath, cacheFilePath, imageParams)
-	})
+	// image name makes the tasks which are abandoned on shutdown
+	// recognizable in logs and md5 keeps the variants apart
+	taskID := "convert:" + tenant.imageName(imageParams.ImageID) + ":" + imageParams.getMd5()
+	failureTTL := time.Duration(settings.Config.FailedConversionTTL) * time.Second
+	if failureTTL > 0 {
+		// failures are answered without taking conversion tokens
+		if reason, ok := handler.Failures.Get(taskID, time.Now()); ok {
+			conversionFailedResponse(ctx, reason)
+			return
+		}
+	}
+
+	if !handler.allowRequest(ctx, settings.ConversionLimiter) {
+		return
+	}
+
+	imagePath := getFilePathFromImageID(tenant.DataDir, imageParams.ImageID)
+
+	// waiting for conversion stops on convert timeout or
+	// when the client closes the connection
+	taskCtx, cancel := convertContext(ctx, settings.Config)
+	defer cancel()
+	var cost int64
+	err = nil
+	if settings.Config.ConvertMemoryBudget > 0 || imageParams.Limits.enabled() {
+		// missing or broken images fail in conversion
+		if width, height, sizeErr := readImageFileSize(imagePath); sizeErr == nil {
+			cost = estimateConvertMemory(width, height)
+			// images exceeding the limits are not queued with their huge cost
+			if limitErr := imageParams.Limits.check(width, height); limitErr != nil {
+				err = &ConversionError{limitErr}
+			}
+		}
+	}
+	if err == nil {
+		err = handler.TaskManager.RunTask(taskCtx, taskID, cost, func() error {
+			return convertFunction(imagePath, cacheFilePath, imageParams)
+		})
+	}
 
 	if err != nil {
 		if os.IsNotExist(err) {
 			jsonResponse(ctx, 404, ErrorImageNotFound)
 			return
 		}
+		if isConversionFailure(err) {
+			logger.Error("Image conversion failed",
+				"image", tenant.imageName(imageParams.ImageID), "error", err)
+			if failureTTL > 0 {
+				handler.Failures.Add(taskID, err.Error(), failureTTL, time.Now())
+			}
+			conversionFailedResponse(ctx, err.Error())
+			return
+		}
+		if err == ErrQueueFull {
+			logger.Warn("Conversion queue is full", "queued", handler.TaskManager.QueueLength())
+			if handler.serveFallback(ctx, settings.Config, tenant, imageParams) {
+				return
+			}
+		}
+		if taskErrorResponse(ctx, err) {
+			return
+		}
 		panic(err)
 	}
 
@@ -238,6 +944,75 @@ func (handler *Handler) handleFetch(ctx *fasthttp.RequestCtx) {
 	handler.serveFileFromDisk(ctx, cacheFilePath, false)
 }
 
+// taskErrorResponse writes the response of the errors which are
+// returned by TaskManager and reports whether the error was handled.
+func taskErrorResponse(ctx *fasthttp.RequestCtx, err error) bool {
+	switch err {
+	case ErrShuttingDown:
+		jsonResponse(ctx, 503, ErrorShuttingDown)
+	case ErrTaskCancelled:
+		jsonResponse(ctx, 503, ErrorConvertCancelled)
+	case ErrTaskTimeout:
+		jsonResponse(ctx, 504, ErrorConvertTimeout)
+	case ErrQueueFull:
+		ctx.Response.Header.Set("Retry-After", "1")
+		jsonResponse(ctx, 503, ErrorQueueFull)
+	default:
+		return false
+	}
+	return true
+}
+
+// isConversionFailure reports whether the error is caused by the
+// original image, so that retrying the conversion would fail again.
+// Panics are bugs of the server and are not conversion failures.
+func isConversionFailure(err error) bool {
+	_, ok := err.(*ConversionError)
+	return ok
+}
+
+func conversionFailedResponse(ctx *fasthttp.RequestCtx, reason string) {
+	body, err := json.Marshal(map[string]string{
+		"error": fmt.Sprintf("Image could not be converted: %s", reason),
+	})
+	if err != nil {
+		panic(err)
+	}
+	jsonResponse(ctx, 422, body)
+}
+
+// serveFallback serves a cached variant of the image with lower
+// quality or the original image, according to queue_full_fallback
+// config, when the image can not be converted because the queue is
+// full. Fallback responses are not cached by clients.
+func (handler *Handler) serveFallback(ctx *fasthttp.RequestCtx, config *Config, tenant *Tenant, imageParams *ImageParams) bool {
+	if config.QueueFullFallback == FallbackNone {
+		return false
+	}
+	qualities := append([]int{config.DefaultImageQuality}, tenant.ValidImageQualities...)
+	sort.Sort(sort.Reverse(sort.IntSlice(qualities)))
+	served := false
+	for _, quality := range qualities {
+		if quality >= imageParams.Quality {
+			continue
+		}
+		params := *imageParams
+		params.Quality = quality
+		if served = handler.serveFileFromDisk(ctx, params.getCachePath(tenant.DataDir), false); served {
+			break
+		}
+	}
+	if !served && config.QueueFullFallback == FallbackOriginal {
+		imagePath := getFilePathFromImageID(tenant.DataDir, imageParams.ImageID)
+		served = handler.serveFileFromDisk(ctx, imagePath, true)
+	}
+	if served {
+		ctx.SetUserValue(CacheStatusKey, "fallback")
+		ctx.Response.Header.SetBytesKV(CacheControlKey, PrivateCacheControl)
+	}
+	return served
+}
+
 func (handler *Handler) handleErrors(ctx *fasthttp.RequestCtx, err error) {
 	if _, ok := err.(*fasthttp.ErrSmallBuffer); ok {
 		jsonResponse(ctx, 431, []byte(`{"error": "Too big request header"}`))
@@ -252,7 +1027,7 @@ func (handler *Handler) serveFileFromDisk(ctx *fasthttp.RequestCtx, filePath str
 	f, err := os.Open(filePath)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			log.Println(err)
+			logger.Error("Could not open file", "error", err)
 		}
 		return false
 	}
@@ -264,7 +1039,7 @@ func (handler *Handler) serveFileFromDisk(ctx *fasthttp.RequestCtx, filePath str
 	}
 	f.Close()
 	ctx.SetBody(buffer.B)
-	ctx.Response.Header.SetBytesKV(CacheControlKey, handler.CacheControlHeader)
+	ctx.Response.Header.SetBytesKV(CacheControlKey, handler.settings().CacheControlHeader)
 	if setContentType {
 		ctx.SetContentType(http.DetectContentType(buffer.B))
 	}
@@ -9,21 +9,26 @@ import (
 	"github.com/valyala/fasthttp/fasthttputil"
 	bimg "gopkg.in/h2non/bimg.v1"
 	"io/ioutil"
-	"log"
+	"math"
 	"mime/multipart"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
-	defaultToken = []byte("123")
-	testFilePNG  = "./testdata/test.png"
-	testFileJPEG = "./testdata/test.jpg"
-	testFileWEBP = "./testdata/test.webp"
-	testFilePDF  = "./testdata/test.pdf"
+	defaultToken    = []byte("123")
+	testFilePNG     = "./testdata/test.png"
+	testFileJPEG    = "./testdata/test.jpg"
+	testFileWEBP    = "./testdata/test.webp"
+	testFilePDF     = "./testdata/test.pdf"
+	testFileBomb    = "./testdata/bomb.png"
+	testFileRotated = "./testdata/rotated.jpg"
 )
 
 type UploadResult struct {
@@ -53,6 +58,15 @@ func createUploadRequest(
 	method string,
 	token []byte,
 	paramName, path string,
+) *fasthttp.Request {
+	return createUploadRequestWithFields(method, token, paramName, path, nil)
+}
+
+func createUploadRequestWithFields(
+	method string,
+	token []byte,
+	paramName, path string,
+	fields map[string]string,
 ) *fasthttp.Request {
 	file, err := os.Open(path)
 	if err != nil {
@@ -78,6 +92,11 @@ func createUploadRequest(
 	if err != nil {
 		panic(err)
 	}
+	for key, val := range fields {
+		if err := writer.WriteField(key, val); err != nil {
+			panic(err)
+		}
+	}
 	ct := writer.FormDataContentType()
 	err = writer.Close()
 	if err != nil {
@@ -216,6 +235,17 @@ func TestUploadFunc(t *testing.T) {
 			expectedStatus: 400,
 			expectedError:  ErrorFileIsNotImage,
 		},
+		{
+			name:           "Failed Decompression Bomb Upload",
+			method:         "POST",
+			imagePath:      testFileBomb,
+			imageParamName: "image_file",
+			token:          defaultToken,
+			expectedStatus: 400,
+			expectedError: []byte(
+				`{"error": "Image dimensions 50000x50000 exceed the maximum of 30000 pixels per side."}`,
+			),
+		},
 	}
 
 	for _, tc := range tt {
@@ -611,7 +641,7 @@ func TestConcurentConversionRequests(t *testing.T) {
 
 	// test task 500 response on convert panic
 
-	log.SetOutput(ioutil.Discard)
+	logger.setOutput(ioutil.Discard)
 	convertFunction = func(inputPath, outputPath string, params *ImageParams) error {
 		panic("Bizzare error")
 	}
@@ -622,7 +652,7 @@ func TestConcurentConversionRequests(t *testing.T) {
 	is.Equal(resp.StatusCode(), 500)
 	is.Equal(resp.Body(), ErrorServerError)
 	convertFunction = convert
-	log.SetOutput(os.Stdout)
+	logger.setOutput(os.Stdout)
 }
 
 func TestAllSizesAndQualitiesAreAvailableWhenDebugging(t *testing.T) {
@@ -647,3 +677,944 @@ func TestAllSizesAndQualitiesAreAvailableWhenDebugging(t *testing.T) {
 	resp = serve(server, req)
 	is.Equal(resp.StatusCode(), 200)
 }
+
+func TestImageInfoHandlers(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	uploadReq := createUploadRequestWithFields(
+		"POST", defaultToken,
+		"image_file", testFileJPEG,
+		map[string]string{"metadata": "[1, 2]"},
+	)
+	uploadResp := serve(server, uploadReq)
+	is.Equal(uploadResp.StatusCode(), 400)
+	is.Equal(uploadResp.Body(), ErrorInvalidMetadata)
+
+	uploadReq = createUploadRequestWithFields(
+		"POST", defaultToken,
+		"image_file", testFileJPEG,
+		map[string]string{
+			"metadata": `{"owner": "blog", "alt": "A cat"}`,
+			"tags":     "cat, animal",
+		},
+	)
+	uploadResp = serve(server, uploadReq)
+	is.Equal(uploadResp.StatusCode(), 200)
+	catImage := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), catImage))
+
+	uploadReq = createUploadRequest(
+		"POST", defaultToken,
+		"image_file", testFilePNG,
+	)
+	uploadResp = serve(server, uploadReq)
+	is.Equal(uploadResp.StatusCode(), 200)
+	plainImage := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), plainImage))
+
+	infoURI := fmt.Sprintf("http://test/info/%s", catImage.ImageID)
+	resp := serve(server, createRequest(infoURI, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 401)
+
+	resp = serve(server, createRequest(infoURI, "GET", defaultToken, nil))
+	is.Equal(resp.StatusCode(), 200)
+	info := &ImageInfo{}
+	is.NoErr(json.Unmarshal(resp.Body(), info))
+	is.Equal(info.ImageID, catImage.ImageID)
+	is.Equal(info.Metadata, map[string]string{"owner": "blog", "alt": "A cat"})
+	is.Equal(info.Tags, []string{"cat", "animal"})
+
+	resp = serve(server, createRequest(
+		fmt.Sprintf("http://test/info/%s", plainImage.ImageID), "GET", defaultToken, nil,
+	))
+	is.Equal(resp.StatusCode(), 200)
+	is.Equal(string(resp.Body()), fmt.Sprintf(
+		`{"image_id":"%s","metadata":{},"tags":[],"private":false}`, plainImage.ImageID,
+	))
+
+	resp = serve(server, createRequest("http://test/info/123456789", "GET", defaultToken, nil))
+	is.Equal(resp.StatusCode(), 404)
+	is.Equal(resp.Body(), ErrorImageNotFound)
+
+	resp = serve(server, createRequest(infoURI, "PUT", defaultToken, bytes.NewBufferString("hi")))
+	is.Equal(resp.StatusCode(), 400)
+	is.Equal(resp.Body(), ErrorInvalidInfo)
+
+	resp = serve(server, createRequest(
+		infoURI, "PUT", defaultToken, bytes.NewBufferString(`{"tags": ["cat", "pet"]}`),
+	))
+	is.Equal(resp.StatusCode(), 200)
+	info = &ImageInfo{}
+	is.NoErr(json.Unmarshal(resp.Body(), info))
+	is.Equal(info.Metadata, map[string]string{"owner": "blog", "alt": "A cat"})
+	is.Equal(info.Tags, []string{"cat", "pet"})
+
+	resp = serve(server, createRequest(
+		infoURI, "PUT", defaultToken, bytes.NewBufferString(`{"focal_point": {"x": 2, "y": 0.5}}`),
+	))
+	is.Equal(resp.StatusCode(), 400)
+	is.Equal(resp.Body(), ErrorInvalidInfo)
+
+	resp = serve(server, createRequest(
+		infoURI, "PUT", defaultToken, bytes.NewBufferString(`{"focal_point": {"x": 0.25, "y": 0.75}}`),
+	))
+	is.Equal(resp.StatusCode(), 200)
+	info = &ImageInfo{}
+	is.NoErr(json.Unmarshal(resp.Body(), info))
+	is.Equal(info.FocalPoint, &FocalPoint{X: 0.25, Y: 0.75})
+	is.Equal(info.Tags, []string{"cat", "pet"})
+
+	resp = serve(server, createRequest(
+		infoURI, "PUT", defaultToken, bytes.NewBufferString(`{"focal_point": null}`),
+	))
+	is.Equal(resp.StatusCode(), 200)
+	info = &ImageInfo{}
+	is.NoErr(json.Unmarshal(resp.Body(), info))
+	is.True(info.FocalPoint == nil)
+
+	listImages := func(query string) []string {
+		resp := serve(server, createRequest("http://test/list/"+query, "GET", defaultToken, nil))
+		is.Equal(resp.StatusCode(), 200)
+		result := &struct {
+			Images []*ImageInfo `json:"images"`
+		}{}
+		is.NoErr(json.Unmarshal(resp.Body(), result))
+		imageIDs := []string{}
+		for _, info := range result.Images {
+			imageIDs = append(imageIDs, info.ImageID)
+		}
+		return imageIDs
+	}
+
+	is.Equal(len(listImages("")), 2)
+	is.Equal(listImages("?tag=pet"), []string{catImage.ImageID})
+	is.Equal(listImages("?tag=pet&owner=blog"), []string{catImage.ImageID})
+	is.Equal(listImages("?tag=animal"), []string{})
+	is.Equal(listImages("?owner=shop"), []string{})
+
+	// pages are ordered by image id
+	listPage := func(query string) *ImageList {
+		resp := serve(server, createRequest("http://test/list/"+query, "GET", defaultToken, nil))
+		is.Equal(resp.StatusCode(), 200)
+		list := &ImageList{}
+		is.NoErr(json.Unmarshal(resp.Body(), list))
+		return list
+	}
+	firstPage := listPage("?limit=1")
+	is.Equal(len(firstPage.Images), 1)
+	is.Equal(firstPage.Next, firstPage.Images[0].ImageID)
+	secondPage := listPage("?limit=1&after=" + firstPage.Next)
+	is.Equal(len(secondPage.Images), 1)
+	is.Equal(secondPage.Next, "")
+	is.True(firstPage.Images[0].ImageID < secondPage.Images[0].ImageID)
+
+	for _, limit := range []string{"0", "1001", "many"} {
+		resp := serve(server, createRequest("http://test/list/?limit="+limit, "GET", defaultToken, nil))
+		is.Equal(resp.StatusCode(), 400)
+	}
+
+	resp = serve(server, createRequest(
+		fmt.Sprintf("http://test/delete/%s", catImage.ImageID), "DELETE", defaultToken, nil,
+	))
+	is.Equal(resp.StatusCode(), 204)
+	_, err := os.Stat(getInfoPathFromImageID(config.DataDir, catImage.ImageID))
+	is.True(os.IsNotExist(err))
+	is.Equal(listImages(""), []string{plainImage.ImageID})
+}
+
+func TestTenants(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.Tenants = []*Tenant{
+		{Name: "blog", Tokens: []*APIToken{newAdminToken("blog-token")}},
+		{Name: "shop", Tokens: []*APIToken{newAdminToken("shop-token")}, StorageQuota: 1},
+	}
+	for _, tenant := range config.Tenants {
+		is.NoErr(tenant.setup(config))
+	}
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	upload := func(tenantPrefix string, token string, path string) *fasthttp.Response {
+		req := createUploadRequest("POST", []byte(token), "image_file", path)
+		req.SetRequestURI(fmt.Sprintf("http://test%s/upload/", tenantPrefix))
+		return serve(server, req)
+	}
+
+	resp := upload("/blog", string(defaultToken), testFileJPEG)
+	is.Equal(resp.StatusCode(), 401)
+	resp = upload("", "blog-token", testFileJPEG)
+	is.Equal(resp.StatusCode(), 401)
+
+	resp = upload("/blog", "blog-token", testFileJPEG)
+	is.Equal(resp.StatusCode(), 200)
+	blogImage := &UploadResult{}
+	is.NoErr(json.Unmarshal(resp.Body(), blogImage))
+	_, err := os.Stat(getFilePathFromImageID(config.Tenants[0].DataDir, blogImage.ImageID))
+	is.NoErr(err)
+
+	// image is only available under the tenant prefix
+	resp = serve(server, createRequest(
+		fmt.Sprintf("http://test/image/%s", blogImage.ImageID), "GET", nil, nil,
+	))
+	is.Equal(resp.StatusCode(), 404)
+	resp = serve(server, createRequest(
+		fmt.Sprintf("http://test/shop/image/%s", blogImage.ImageID), "GET", nil, nil,
+	))
+	is.Equal(resp.StatusCode(), 404)
+	resp = serve(server, createRequest(
+		fmt.Sprintf("http://test/blog/image/%s", blogImage.ImageID), "GET", nil, nil,
+	))
+	is.Equal(resp.StatusCode(), 200)
+
+	// other tenants cannot delete the image
+	resp = serve(server, createRequest(
+		fmt.Sprintf("http://test/shop/delete/%s", blogImage.ImageID), "DELETE", []byte("shop-token"), nil,
+	))
+	is.Equal(resp.StatusCode(), 404)
+	resp = serve(server, createRequest(
+		fmt.Sprintf("http://test/blog/delete/%s", blogImage.ImageID), "DELETE", []byte("shop-token"), nil,
+	))
+	is.Equal(resp.StatusCode(), 401)
+	resp = serve(server, createRequest(
+		fmt.Sprintf("http://test/blog/delete/%s", blogImage.ImageID), "DELETE", []byte("blog-token"), nil,
+	))
+	is.Equal(resp.StatusCode(), 204)
+
+	// size of test.png is about 800KB and quota of shop is 1MB
+	resp = upload("/shop", "shop-token", testFilePNG)
+	is.Equal(resp.StatusCode(), 200)
+	resp = upload("/shop", "shop-token", testFilePNG)
+	is.Equal(resp.StatusCode(), 413)
+	is.Equal(resp.Body(), ErrorQuotaExceeded)
+	resp = upload("/shop", "shop-token", testFileJPEG)
+	is.Equal(resp.StatusCode(), 200)
+}
+
+func TestTokenScopes(t *testing.T) {
+	config := getTestConfig()
+	config.Token = ""
+	config.Tokens = []*APIToken{
+		{Name: "uploader", Token: "upload-token", Scopes: []string{ScopeUpload}},
+		{Name: "cleaner", Token: "delete-token", Scopes: []string{ScopeDelete}},
+		{Name: "reader", Token: "read-token", Scopes: []string{ScopeReadPrivate}},
+		{Name: "admin", Token: "admin-token", Scopes: []string{ScopeAdmin}},
+	}
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	tt := []struct {
+		token        string
+		uploadStatus int
+		infoStatus   int
+		listStatus   int
+		deleteStatus int
+	}{
+		{"invalid-token", 401, 401, 401, 401},
+		{"upload-token", 200, 403, 403, 403},
+		{"delete-token", 403, 403, 403, 404},
+		{"read-token", 403, 404, 200, 403},
+		{"admin-token", 200, 404, 200, 404},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.token, func(t *testing.T) {
+			is := is.NewRelaxed(t)
+			token := []byte(tc.token)
+			resp := serve(server, createUploadRequest("POST", token, "image_file", testFileJPEG))
+			is.Equal(resp.StatusCode(), tc.uploadStatus)
+			resp = serve(server, createRequest("http://test/info/123456789", "GET", token, nil))
+			is.Equal(resp.StatusCode(), tc.infoStatus)
+			resp = serve(server, createRequest("http://test/list/", "GET", token, nil))
+			is.Equal(resp.StatusCode(), tc.listStatus)
+			resp = serve(server, createRequest("http://test/delete/123456789", "DELETE", token, nil))
+			is.Equal(resp.StatusCode(), tc.deleteStatus)
+			if resp.StatusCode() == 403 {
+				is.Equal(resp.Body(), ErrorPermissionDenied)
+			}
+		})
+	}
+}
+
+func TestPreSignedUpload(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	signReq := createRequest("http://test/sign/upload/?formats=png&max_size=1048576", "POST", defaultToken, nil)
+	resp := serve(server, signReq)
+	is.Equal(resp.StatusCode(), 501)
+	is.Equal(resp.Body(), ErrorSigningDisabled)
+
+	config.SigningKey = "secret"
+	resp = serve(server, createRequest("http://test/sign/upload/", "POST", nil, nil))
+	is.Equal(resp.StatusCode(), 401)
+	resp = serve(server, createRequest("http://test/sign/upload/?formats=gif", "POST", defaultToken, nil))
+	is.Equal(resp.StatusCode(), 400)
+
+	resp = serve(server, signReq)
+	is.Equal(resp.StatusCode(), 200)
+	result := &struct {
+		UploadURL string `json:"upload_url"`
+		Expires   int64  `json:"expires"`
+	}{}
+	is.NoErr(json.Unmarshal(resp.Body(), result))
+	is.True(result.Expires > time.Now().Unix())
+
+	upload := func(uri string, path string) *fasthttp.Response {
+		req := createUploadRequest("POST", nil, "image_file", path)
+		req.SetRequestURI("http://test" + uri)
+		return serve(server, req)
+	}
+
+	resp = upload(result.UploadURL, testFilePNG)
+	is.Equal(resp.StatusCode(), 200)
+	resp = upload(result.UploadURL, testFileJPEG)
+	is.Equal(resp.StatusCode(), 400)
+	is.Equal(resp.Body(), ErrorFormatNotAllowed)
+	resp = upload(result.UploadURL+"x", testFilePNG)
+	is.Equal(resp.StatusCode(), 401)
+	is.Equal(string(resp.Body()), `{"error": "Signature is not valid"}`)
+
+	resp = serve(server, createRequest("http://test/sign/upload/?max_size=1000", "POST", defaultToken, nil))
+	is.Equal(resp.StatusCode(), 200)
+	is.NoErr(json.Unmarshal(resp.Body(), result))
+	resp = upload(result.UploadURL, testFileJPEG)
+	is.Equal(resp.StatusCode(), 413)
+	is.Equal(resp.Body(), ErrorImageTooLarge)
+}
+
+func TestPrivateImages(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.SigningKey = "secret"
+	config.Tokens = []*APIToken{
+		{Name: "uploader", Token: "upload-token", Scopes: []string{ScopeUpload}},
+		{Name: "reader", Token: "read-token", Scopes: []string{ScopeReadPrivate}},
+	}
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	uploadReq := createUploadRequestWithFields(
+		"POST", defaultToken,
+		"image_file", testFileJPEG,
+		map[string]string{"private": "true"},
+	)
+	uploadResp := serve(server, uploadReq)
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+
+	imageURI := fmt.Sprintf("http://test/image/%s", uploadResult.ImageID)
+	resp := serve(server, createRequest(imageURI, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 403)
+	is.Equal(resp.Body(), ErrorImageIsPrivate)
+	resp = serve(server, createRequest(imageURI, "GET", []byte("upload-token"), nil))
+	is.Equal(resp.StatusCode(), 403)
+	resp = serve(server, createRequest(imageURI, "GET", []byte("read-token"), nil))
+	is.Equal(resp.StatusCode(), 200)
+	is.Equal(string(resp.Header.Peek("Cache-Control")), "private, no-store")
+
+	variantURI := fmt.Sprintf("http://test/image/w=500,h=500/%s", uploadResult.ImageID)
+	resp = serve(server, createRequest(variantURI, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 403)
+
+	signURI := fmt.Sprintf("http://test/sign/image/%s?expires_in=60", uploadResult.ImageID)
+	resp = serve(server, createRequest(signURI, "GET", []byte("upload-token"), nil))
+	is.Equal(resp.StatusCode(), 403)
+	resp = serve(server, createRequest(signURI, "GET", []byte("read-token"), nil))
+	is.Equal(resp.StatusCode(), 200)
+	result := &struct {
+		URL string `json:"url"`
+	}{}
+	is.NoErr(json.Unmarshal(resp.Body(), result))
+
+	resp = serve(server, createRequest("http://test"+result.URL, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 200)
+	is.Equal(string(resp.Header.ContentType()), "image/jpeg")
+
+	// signature of the original image is not valid for its variants
+	resp = serve(server, createRequest(
+		strings.Replace("http://test"+result.URL, "/image/", "/image/w=500,h=500/", 1), "GET", nil, nil,
+	))
+	is.Equal(resp.StatusCode(), 403)
+
+	// expired signature
+	expiredURL := signImageURL(config.SigningKey, "/image/"+uploadResult.ImageID, time.Now().Unix()-1)
+	resp = serve(server, createRequest("http://test"+expiredURL, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 403)
+}
+
+func TestPrivateImagesNeedTokens(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.Token = ""
+	config.SigningKey = "secret"
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	// everyone is authorized without tokens, so images can not be private
+	uploadReq := createUploadRequestWithFields(
+		"POST", nil,
+		"image_file", testFileJPEG,
+		map[string]string{"private": "true"},
+	)
+	resp := serve(server, uploadReq)
+	is.Equal(resp.StatusCode(), 400)
+	is.Equal(resp.Body(), ErrorPrivateDisabled)
+
+	uploadResp := serve(server, createUploadRequest("POST", nil, "image_file", testFileJPEG))
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+
+	infoURI := fmt.Sprintf("http://test/info/%s", uploadResult.ImageID)
+	resp = serve(server, createRequest(infoURI, "PUT", nil, bytes.NewBufferString(`{"private": true}`)))
+	is.Equal(resp.StatusCode(), 400)
+	is.Equal(resp.Body(), ErrorPrivateDisabled)
+
+	signURI := fmt.Sprintf("http://test/sign/image/%s", uploadResult.ImageID)
+	resp = serve(server, createRequest(signURI, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 501)
+	is.Equal(resp.Body(), ErrorPrivateDisabled)
+}
+
+func TestRateLimit(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.RateLimit = RateLimitConfig{
+		CacheHits:      RateLimit{Rate: 0.001, Burst: 2},
+		TrustedProxies: []string{"0.0.0.0"},
+	}
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	uploadResp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+
+	fetch := func(clientIP string) *fasthttp.Response {
+		req := createRequest(fmt.Sprintf("http://test/image/%s", uploadResult.ImageID), "GET", nil, nil)
+		req.Header.Set("X-Forwarded-For", clientIP)
+		return serve(server, req)
+	}
+
+	is.Equal(fetch("1.1.1.1").StatusCode(), 200)
+	is.Equal(fetch("1.1.1.1").StatusCode(), 200)
+	resp := fetch("1.1.1.1")
+	is.Equal(resp.StatusCode(), 429)
+	is.Equal(resp.Body(), ErrorTooManyRequests)
+	is.Equal(string(resp.Header.Peek("Retry-After")), "1000")
+	is.Equal(fetch("2.2.2.2").StatusCode(), 200)
+}
+
+func TestHotlinkProtection(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.HotlinkProtection = HotlinkConfig{AllowedReferers: []string{"example.com"}}
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	uploadResp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+
+	fetch := func(referer string) *fasthttp.Response {
+		req := createRequest(fmt.Sprintf("http://test/image/%s", uploadResult.ImageID), "GET", nil, nil)
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		return serve(server, req)
+	}
+
+	is.Equal(fetch("https://example.com/blog/").StatusCode(), 200)
+	is.Equal(fetch("").StatusCode(), 403)
+	resp := fetch("https://other.com/")
+	is.Equal(resp.StatusCode(), 403)
+	is.Equal(resp.Body(), ErrorHotlinkForbidden)
+
+	config.HotlinkProtection.AllowEmptyReferer = true
+	config.HotlinkProtection.PlaceholderImage = testFilePNG
+	is.Equal(fetch("").StatusCode(), 200)
+	resp = fetch("https://other.com/")
+	is.Equal(resp.StatusCode(), 200)
+	is.Equal(string(resp.Header.ContentType()), "image/png")
+	is.Equal(string(resp.Header.Peek("Cache-Control")), "private, no-store")
+}
+
+func TestCORS(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	preflight := func(path string, origin string) *fasthttp.Response {
+		req := createRequest("http://test"+path, "OPTIONS", nil, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		return serve(server, req)
+	}
+
+	// CORS is disabled by default
+	resp := preflight("/upload/", "https://example.com")
+	is.Equal(resp.StatusCode(), 405)
+	is.Equal(len(resp.Header.Peek("Access-Control-Allow-Origin")), 0)
+
+	config.CORS = CORSConfig{
+		AllowedOrigins: []string{"https://example.com"},
+		AllowedHeaders: []string{"Token"},
+		MaxAge:         600,
+	}
+	resp = preflight("/upload/", "https://example.com")
+	is.Equal(resp.StatusCode(), 204)
+	is.Equal(string(resp.Header.Peek("Access-Control-Allow-Origin")), "https://example.com")
+	is.Equal(string(resp.Header.Peek("Access-Control-Allow-Methods")), "GET, POST, PUT, DELETE")
+	is.Equal(string(resp.Header.Peek("Access-Control-Allow-Headers")), "Token")
+	is.Equal(string(resp.Header.Peek("Access-Control-Max-Age")), "600")
+	is.Equal(string(resp.Header.Peek("Vary")), "Origin")
+
+	resp = preflight("/image/abcdefghijk", "https://other.com")
+	is.Equal(resp.StatusCode(), 403)
+	is.Equal(resp.Body(), ErrorOriginNotAllowed)
+
+	req := createUploadRequest("POST", defaultToken, "image_file", testFileJPEG)
+	req.Header.Set("Origin", "https://example.com")
+	resp = serve(server, req)
+	is.Equal(resp.StatusCode(), 200)
+	is.Equal(string(resp.Header.Peek("Access-Control-Allow-Origin")), "https://example.com")
+
+	req = createRequest("http://test/image/abcdefghijk", "GET", nil, nil)
+	req.Header.Set("Origin", "https://other.com")
+	resp = serve(server, req)
+	is.Equal(len(resp.Header.Peek("Access-Control-Allow-Origin")), 0)
+}
+
+func TestReloadConfig(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	handler := newHandler(config)
+	server := handler.createServer()
+	defer os.RemoveAll(config.DataDir)
+
+	list := func(token string) *fasthttp.Response {
+		return serve(server, createRequest("http://test/list/", "GET", []byte(token), nil))
+	}
+	is.Equal(list(string(defaultToken)).StatusCode(), 200)
+	is.Equal(list("new-token").StatusCode(), 401)
+
+	newConfig := getTestConfig()
+	defer os.RemoveAll(newConfig.DataDir)
+	newConfig.DataDir = config.DataDir
+	newConfig.Token = "new-token"
+	newConfig.HTTPCacheTTL = 0
+	is.NoErr(handler.Reload(newConfig))
+
+	is.Equal(list(string(defaultToken)).StatusCode(), 401)
+	is.Equal(list("new-token").StatusCode(), 200)
+	is.Equal(handler.config(), newConfig)
+	is.Equal(string(handler.settings().CacheControlHeader), "private, no-cache, no-store, must-revalidate")
+
+	// invalid settings are rejected and the current ones are kept
+	invalidConfig := getTestConfig()
+	defer os.RemoveAll(invalidConfig.DataDir)
+	invalidConfig.RateLimit.TrustedProxies = []string{"invalid"}
+	is.True(handler.Reload(invalidConfig) != nil)
+	is.Equal(handler.config(), newConfig)
+}
+
+func TestAccessLog(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.AccessLog = true
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	buf := &bytes.Buffer{}
+	logger.setOutput(buf)
+	defer logger.setOutput(os.Stdout)
+
+	resp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(resp.StatusCode(), 200)
+	resp = serve(server, createRequest("http://test/image/abcdefghijk", "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 404)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	is.Equal(len(lines), 3)
+	is.True(strings.Contains(lines[0], "INFO Image uploaded"))
+	is.True(strings.Contains(lines[1], "INFO Request method=POST path=/upload/ status=200 bytes="))
+	is.True(strings.Contains(lines[1], `cache="" client_ip=0.0.0.0 token=default`))
+	is.True(strings.Contains(lines[2], "INFO Request method=GET path=/image/abcdefghijk status=404"))
+	is.True(strings.Contains(lines[2], "duration_ms="))
+}
+
+func TestConvertTimeout(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.ConvertTimeout = 1
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	uploadResp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+
+	release, finished := make(chan struct{}), make(chan struct{})
+	convertFunction = func(inputPath, outputPath string, params *ImageParams) error {
+		<-release
+		close(finished)
+		return nil
+	}
+
+	reqURI := fmt.Sprintf("http://test/image/w=500,h=500/%s", uploadResult.ImageID)
+	resp := serve(server, createRequest(reqURI, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 504)
+	is.Equal(resp.Body(), ErrorConvertTimeout)
+
+	close(release)
+	<-finished
+	convertFunction = convert
+}
+
+func TestAbandonedConversionsAreReportedByImage(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	handler := newHandler(config)
+	server := handler.createServer()
+	defer os.RemoveAll(config.DataDir)
+
+	uploadResp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+
+	release, started := make(chan struct{}), make(chan struct{})
+	convertFunction = func(inputPath, outputPath string, params *ImageParams) error {
+		close(started)
+		<-release
+		return nil
+	}
+	defer func() { convertFunction = convert }()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		uri := fmt.Sprintf("http://test/image/w=500,h=500/%s", uploadResult.ImageID)
+		serve(server, createRequest(uri, "GET", nil, nil))
+	}()
+	<-started
+
+	abandoned := handler.TaskManager.Shutdown(0)
+	is.Equal(len(abandoned), 1)
+	is.True(strings.HasPrefix(abandoned[0], "convert:"+uploadResult.ImageID+":"))
+	close(release)
+	<-done
+}
+
+func TestFailedConversionsAreCached(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+	logger.setOutput(ioutil.Discard)
+	defer logger.setOutput(os.Stdout)
+
+	uploadResp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+
+	var calls int64
+	convertFunction = func(inputPath, outputPath string, params *ImageParams) error {
+		atomic.AddInt64(&calls, 1)
+		return &ConversionError{fmt.Errorf("VipsJpeg: Premature end of JPEG file")}
+	}
+	defer func() { convertFunction = convert }()
+
+	expectedBody := `{"error":"Image could not be converted: VipsJpeg: Premature end of JPEG file"}`
+	reqURI := fmt.Sprintf("http://test/image/w=500,h=500/%s", uploadResult.ImageID)
+	for i := 0; i < 3; i++ {
+		resp := serve(server, createRequest(reqURI, "GET", nil, nil))
+		is.Equal(resp.StatusCode(), 422)
+		is.Equal(string(resp.Body()), expectedBody)
+	}
+	is.Equal(atomic.LoadInt64(&calls), int64(1))
+
+	// failures are cached per cache key
+	reqURI = fmt.Sprintf("http://test/image/w=100,h=100/%s", uploadResult.ImageID)
+	resp := serve(server, createRequest(reqURI, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 422)
+	is.Equal(atomic.LoadInt64(&calls), int64(2))
+
+	// errors which are not caused by the image are not cached
+	convertFunction = func(inputPath, outputPath string, params *ImageParams) error {
+		atomic.AddInt64(&calls, 1)
+		return fmt.Errorf("No space left on device")
+	}
+	reqURI = fmt.Sprintf("http://test/image/w=100,h=100,fit=cover/%s", uploadResult.ImageID)
+	for i := 0; i < 2; i++ {
+		resp := serve(server, createRequest(reqURI, "GET", nil, nil))
+		is.Equal(resp.StatusCode(), 500)
+	}
+	is.Equal(atomic.LoadInt64(&calls), int64(4))
+
+	// nor panics which are bugs of the server
+	convertFunction = func(inputPath, outputPath string, params *ImageParams) error {
+		atomic.AddInt64(&calls, 1)
+		panic("Bizzare error")
+	}
+	for i := 0; i < 2; i++ {
+		resp := serve(server, createRequest(reqURI, "GET", nil, nil))
+		is.Equal(resp.StatusCode(), 500)
+		is.Equal(resp.Body(), ErrorServerError)
+	}
+	is.Equal(atomic.LoadInt64(&calls), int64(6))
+}
+
+func TestCachedFailuresDoNotTakeConversionTokens(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.RateLimit.Conversions = RateLimit{Rate: 0.001, Burst: 2}
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+	logger.setOutput(ioutil.Discard)
+	defer logger.setOutput(os.Stdout)
+
+	uploadResp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+
+	convertFunction = func(inputPath, outputPath string, params *ImageParams) error {
+		return &ConversionError{fmt.Errorf("VipsJpeg: Premature end of JPEG file")}
+	}
+	defer func() { convertFunction = convert }()
+
+	reqURI := fmt.Sprintf("http://test/image/w=500,h=500/%s", uploadResult.ImageID)
+	for i := 0; i < 3; i++ {
+		resp := serve(server, createRequest(reqURI, "GET", nil, nil))
+		is.Equal(resp.StatusCode(), 422)
+	}
+
+	// only the first request has taken a token
+	reqURI = fmt.Sprintf("http://test/image/w=100,h=100/%s", uploadResult.ImageID)
+	resp := serve(server, createRequest(reqURI, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 422)
+	reqURI = fmt.Sprintf("http://test/image/w=500,h=200/%s", uploadResult.ImageID)
+	resp = serve(server, createRequest(reqURI, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 429)
+}
+
+func TestUploadWithoutImageLimits(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.MaxPixels = 0
+	config.MaxImageDimension = 0
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+
+	// dimensions are not read when there is no limit
+	imagePath := filepath.Join(config.DataDir, "arithmetic.jpg")
+	is.NoErr(ioutil.WriteFile(imagePath, arithmeticJPEG, 0644))
+	resp := serve(server, createUploadRequest("POST", defaultToken, "image_file", imagePath))
+	is.Equal(resp.StatusCode(), 200)
+}
+
+func TestImagesExceedingLimitsAreNotQueued(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.ConvertMemoryBudget = 1
+	handler := newHandler(config)
+	server := handler.createServer()
+	defer os.RemoveAll(config.DataDir)
+	logger.setOutput(ioutil.Discard)
+	defer logger.setOutput(os.Stdout)
+
+	uploadResp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+
+	convertFunction = func(inputPath, outputPath string, params *ImageParams) error {
+		t.Error("image exceeding the limits should not be converted")
+		return nil
+	}
+	defer func() { convertFunction = convert }()
+
+	// the image is stored before the limit is lowered
+	config.MaxImageDimension = 10
+	reqURI := fmt.Sprintf("http://test/image/w=500,h=500/%s", uploadResult.ImageID)
+	resp := serve(server, createRequest(reqURI, "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 422)
+	is.True(strings.Contains(string(resp.Body()), "exceed the maximum of 10 pixels per side"))
+	is.Equal(handler.TaskManager.QueueLength(), 0)
+}
+
+func TestUploadNormalization(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.NormalizeUploads = NormalizeConfig{Enabled: true, MaxDimension: 1000, KeepOriginal: true}
+	server := createServer(config)
+	defer os.RemoveAll(config.DataDir)
+	logger.setOutput(ioutil.Discard)
+	defer logger.setOutput(os.Stdout)
+
+	normalizeFunction = func(buf []byte, nc *NormalizeConfig) ([]byte, error) {
+		is.Equal(nc.MaxDimension, 1000)
+		return []byte("normalized"), nil
+	}
+	defer func() { normalizeFunction = normalizeImage }()
+
+	resp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(resp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(resp.Body(), uploadResult))
+
+	imagePath := getFilePathFromImageID(config.DataDir, uploadResult.ImageID)
+	stored, err := ioutil.ReadFile(imagePath)
+	is.NoErr(err)
+	is.Equal(string(stored), "normalized")
+	original, err := ioutil.ReadFile(getOriginalPathFromImageID(config.DataDir, uploadResult.ImageID))
+	is.NoErr(err)
+	expected, err := ioutil.ReadFile(testFileJPEG)
+	is.NoErr(err)
+	is.Equal(original, expected)
+
+	// kept originals are deleted with images
+	resp = serve(server, createRequest(
+		fmt.Sprintf("http://test/delete/%s", uploadResult.ImageID), "DELETE", defaultToken, nil,
+	))
+	is.Equal(resp.StatusCode(), 204)
+	_, err = os.Stat(getOriginalPathFromImageID(config.DataDir, uploadResult.ImageID))
+	is.True(os.IsNotExist(err))
+
+	normalizeFunction = func(buf []byte, nc *NormalizeConfig) ([]byte, error) {
+		return nil, &ConversionError{fmt.Errorf("Unsupported image format")}
+	}
+	resp = serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(resp.StatusCode(), 422)
+	is.Equal(string(resp.Body()), `{"error":"Image could not be converted: Unsupported image format"}`)
+}
+
+func TestQueueFull(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.ConvertConcurrency = 1
+	config.MaxQueueLength = 1
+	handler := newHandler(config)
+	server := handler.createServer()
+	defer os.RemoveAll(config.DataDir)
+
+	uploadResp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileJPEG))
+	is.Equal(uploadResp.StatusCode(), 200)
+	uploadResult := &UploadResult{}
+	is.NoErr(json.Unmarshal(uploadResp.Body(), uploadResult))
+	imageURI := func(options string) string {
+		return fmt.Sprintf("http://test/image/%s/%s", options, uploadResult.ImageID)
+	}
+
+	release, started := make(chan struct{}), make(chan struct{}, 2)
+	convertFunction = func(inputPath, outputPath string, params *ImageParams) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	var wg sync.WaitGroup
+	for _, options := range []string{"w=500,h=500", "w=100,h=100"} {
+		wg.Add(1)
+		go func(options string) {
+			defer wg.Done()
+			serve(server, createRequest(imageURI(options), "GET", nil, nil))
+		}(options)
+		if options == "w=500,h=500" {
+			<-started
+		}
+	}
+	for handler.TaskManager.QueueLength() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	resp := serve(server, createRequest(imageURI("w=500,h=200,q=95"), "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 503)
+	is.Equal(resp.Body(), ErrorQueueFull)
+	is.Equal(string(resp.Header.Peek("Retry-After")), "1")
+
+	// lower quality variant is served from cache
+	config.QueueFullFallback = FallbackCachedVariant
+	params := &ImageParams{ImageID: uploadResult.ImageID, Width: 500, Height: 200, Fit: FitContain, Quality: 80}
+	cachePath := params.getCachePath(config.DataDir)
+	is.NoErr(os.MkdirAll(filepath.Dir(cachePath), 0755))
+	is.NoErr(ioutil.WriteFile(cachePath, []byte("low quality"), 0644))
+	resp = serve(server, createRequest(imageURI("w=500,h=200,q=95"), "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 200)
+	is.Equal(resp.Body(), []byte("low quality"))
+	is.Equal(string(resp.Header.Peek("Cache-Control")), "private, no-store")
+	resp = serve(server, createRequest(imageURI("w=500,h=200,q=80"), "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 200)
+
+	resp = serve(server, createRequest(imageURI("w=100,h=100,q=95"), "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 503)
+
+	config.QueueFullFallback = FallbackOriginal
+	resp = serve(server, createRequest(imageURI("w=100,h=100,q=95"), "GET", nil, nil))
+	is.Equal(resp.StatusCode(), 200)
+	is.Equal(string(resp.Header.ContentType()), "image/jpeg")
+	is.Equal(string(resp.Header.Peek("Cache-Control")), "private, no-store")
+
+	close(release)
+	<-started
+	wg.Wait()
+	convertFunction = convert
+}
+
+func TestReadiness(t *testing.T) {
+	is := is.New(t)
+	config := getTestConfig()
+	config.MinFreeDiskSpace = 1
+	handler := newHandler(config)
+	server := handler.createServer()
+	defer os.RemoveAll(config.DataDir)
+
+	vipsCheckFunction = func() error { return nil }
+	defer func() { vipsCheckFunction = checkVips }()
+
+	ready := func() (int, *ReadinessReport) {
+		resp := serve(server, createRequest("http://test/ready/", "GET", nil, nil))
+		report := &ReadinessReport{}
+		is.NoErr(json.Unmarshal(resp.Body(), report))
+		return resp.StatusCode(), report
+	}
+
+	status, report := ready()
+	is.Equal(status, 200)
+	is.Equal(report.Status, "ok")
+	is.Equal(len(report.Checks), 4)
+	for _, check := range report.Checks {
+		is.Equal(check.Status, "ok")
+	}
+	is.Equal(report.Checks["task_queue"].Message, fmt.Sprintf("0 of %d queued", config.MaxQueueLength))
+
+	config.MinFreeDiskSpace = math.MaxInt32
+	vipsCheckFunction = func() error { return fmt.Errorf("vips error") }
+	handler.VipsChecker = &VipsChecker{} // result of the previous check is reused
+	status, report = ready()
+	is.Equal(status, 503)
+	is.Equal(report.Status, "fail")
+	is.Equal(report.Checks["data_directory"].Status, "ok")
+	is.Equal(report.Checks["disk_space"].Status, "fail")
+	is.Equal(report.Checks["libvips"], &CheckResult{Status: "fail", Message: "vips error"})
+
+	is.NoErr(os.RemoveAll(config.DataDir))
+	status, report = ready()
+	is.Equal(status, 503)
+	is.Equal(report.Checks["data_directory"].Status, "fail")
+
+	resp := serve(server, createRequest("http://test/ready/", "POST", nil, nil))
+	is.Equal(resp.StatusCode(), 405)
+}
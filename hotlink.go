@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//HotlinkConfig restricts the sites which can embed images.
+//Protection is enabled when AllowedReferers is not empty.
+type HotlinkConfig struct {
+	AllowedReferers   []string `yaml:"allowed_referers"`
+	AllowEmptyReferer bool     `yaml:"allow_empty_referer"`
+	PlaceholderImage  string   `yaml:"placeholder_image"`
+}
+
+func (hc *HotlinkConfig) validate() error {
+	for _, pattern := range hc.AllowedReferers {
+		if pattern == "" || strings.Contains(pattern, "/") || strings.Contains(strings.TrimPrefix(pattern, "*."), "*") {
+			return fmt.Errorf("Referer pattern %s is not valid. Try use example.com or *.example.com format.", pattern)
+		}
+	}
+	if hc.PlaceholderImage != "" {
+		if !filepath.IsAbs(hc.PlaceholderImage) {
+			return fmt.Errorf("Absolute path for placeholder_image needed but got: %s", hc.PlaceholderImage)
+		}
+		if _, err := os.Stat(hc.PlaceholderImage); err != nil {
+			return fmt.Errorf("Could not find placeholder image: %v", err)
+		}
+	}
+	return nil
+}
+
+func (hc *HotlinkConfig) enabled() bool {
+	return len(hc.AllowedReferers) != 0
+}
+
+// hostIsAllowed matches the host against allowed patterns.
+// *.example.com pattern matches all the subdomains of example.com.
+func (hc *HotlinkConfig) hostIsAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range hc.AllowedReferers {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// refererIsAllowed checks the host of Referer header or Origin header
+// if Referer is not sent by the browser.
+func (hc *HotlinkConfig) refererIsAllowed(referer, origin string) bool {
+	if !hc.enabled() {
+		return true
+	}
+	if referer == "" {
+		referer = origin
+	}
+	if referer == "" {
+		return hc.AllowEmptyReferer
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return hc.hostIsAllowed(u.Hostname())
+}
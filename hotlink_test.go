@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestRefererIsAllowed(t *testing.T) {
+	hc := &HotlinkConfig{
+		AllowedReferers:   []string{"example.com", "*.example.org"},
+		AllowEmptyReferer: true,
+	}
+
+	tt := []struct {
+		referer  string
+		origin   string
+		expected bool
+	}{
+		{"", "", true},
+		{"https://example.com/blog/", "", true},
+		{"https://EXAMPLE.com:8443/", "", true},
+		{"https://www.example.com/", "", false},
+		{"https://example.org/", "", false},
+		{"https://cdn.example.org/", "", true},
+		{"https://example.org.evil.com/", "", false},
+		{"", "https://www.example.org", true},
+		{"", "https://evil.com", false},
+		{"not a url", "", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(fmt.Sprintf("%s|%s", tc.referer, tc.origin), func(t *testing.T) {
+			is := is.NewRelaxed(t)
+			is.Equal(hc.refererIsAllowed(tc.referer, tc.origin), tc.expected)
+		})
+	}
+
+	is := is.New(t)
+	hc.AllowEmptyReferer = false
+	is.True(!hc.refererIsAllowed("", ""))
+	hc.AllowedReferers = nil
+	is.True(hc.refererIsAllowed("https://evil.com/", ""))
+}
+
+func TestHotlinkConfigValidate(t *testing.T) {
+	is := is.New(t)
+	is.NoErr((&HotlinkConfig{AllowedReferers: []string{"example.com", "*.example.com"}}).validate())
+	for _, pattern := range []string{"", "*", "*example.com", "example.com/blog", "a.*.com"} {
+		hc := &HotlinkConfig{AllowedReferers: []string{pattern}}
+		is.True(hc.validate() != nil)
+	}
+}
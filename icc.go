@@ -0,0 +1,21 @@
+package main
+
+import (
+	bimg "gopkg.in/h2non/bimg.v1"
+)
+
+// srgbProfile is the name of the sRGB profile which is built in libvips.
+// libvips accepts it instead of a profile path since version 8.7.
+const srgbProfile = "srgb"
+
+// setSRGBTransform makes libvips convert the pixels of images which
+// have an embedded ICC profile to sRGB when the profile is going to be
+// stripped, so that colours of wide gamut images like Display P3 or
+// Adobe RGB do not shift. CMYK images are converted by their profile
+// when their colourspace is changed.
+func setSRGBTransform(options *bimg.Options, metadata bimg.ImageMetadata, keep MetadataOptions) {
+	if !metadata.Profile || metadata.Space == "cmyk" || keep.ICCProfile {
+		return
+	}
+	options.OutputICC = srgbProfile
+}
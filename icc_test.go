@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/matryer/is"
+	bimg "gopkg.in/h2non/bimg.v1"
+)
+
+// testFileProfile is the ICC profile embedded in testFileRotated. Its red
+// and blue primaries are swapped, so that converting it to sRGB swaps the pixels.
+const testFileProfile = "./testdata/swapped-rgb.icc"
+
+func TestTestFileProfile(t *testing.T) {
+	is := is.New(t)
+	profile, err := ioutil.ReadFile(testFileProfile)
+	is.NoErr(err)
+	is.Equal(string(profile[36:40]), "acsp")
+	is.Equal(profile[8], byte(2)) // version 2 profile uses curv curves
+	is.True(bytes.Contains(profile, []byte("curv")))
+	is.True(!bytes.Contains(profile, []byte("para")))
+
+	rotated, err := ioutil.ReadFile(testFileRotated)
+	is.NoErr(err)
+	is.True(bytes.Contains(rotated, profile))
+}
+
+func TestSRGBTransform(t *testing.T) {
+	is := is.New(t)
+	options := &bimg.Options{}
+	setSRGBTransform(options, bimg.ImageMetadata{Profile: true, Space: "srgb"}, MetadataOptions{})
+	is.Equal(options.OutputICC, "srgb")
+
+	// images without profile, CMYK images and kept profiles are not transformed
+	for _, tc := range []struct {
+		metadata bimg.ImageMetadata
+		keep     MetadataOptions
+	}{
+		{bimg.ImageMetadata{Space: "srgb"}, MetadataOptions{}},
+		{bimg.ImageMetadata{Profile: true, Space: "cmyk"}, MetadataOptions{}},
+		{bimg.ImageMetadata{Profile: true, Space: "srgb"}, MetadataOptions{ICCProfile: true}},
+	} {
+		options := &bimg.Options{}
+		setSRGBTransform(options, tc.metadata, tc.keep)
+		is.Equal(options.OutputICC, "")
+	}
+}
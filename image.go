@@ -27,14 +27,43 @@ const (
 	FitScaleDown = "scale-down"
 )
 
+const (
+	//GravityCentre keeps the centre of image when cropping which is the default
+	GravityCentre = "centre"
+	//GravityNorth keeps the top of image when cropping
+	GravityNorth = "north"
+	//GravitySouth keeps the bottom of image when cropping
+	GravitySouth = "south"
+	//GravityEast keeps the right side of image when cropping
+	GravityEast = "east"
+	//GravityWest keeps the left side of image when cropping
+	GravityWest = "west"
+	//GravitySmart keeps the most interesting area of image when cropping
+	GravitySmart = "smart"
+)
+
+var bimgGravities = map[string]bimg.Gravity{
+	GravityCentre: bimg.GravityCentre,
+	GravityNorth:  bimg.GravityNorth,
+	GravitySouth:  bimg.GravitySouth,
+	GravityEast:   bimg.GravityEast,
+	GravityWest:   bimg.GravityWest,
+	GravitySmart:  bimg.GravitySmart,
+}
+
 //ImageParams is request properties for image conversion
 type ImageParams struct {
+	Tenant       string
 	ImageID      string
 	Width        int
 	Height       int
 	Fit          string
 	Quality      int
+	Gravity      string // empty for the default centre gravity
+	FocalPoint   *FocalPoint
 	WebpAccepted bool
+	Limits       ImageLimits
+	KeepMetadata MetadataOptions
 }
 
 func createImageParams(imageID, options string, webpAccepted bool, config *Config) (*ImageParams, error) {
@@ -43,6 +72,8 @@ func createImageParams(imageID, options string, webpAccepted bool, config *Confi
 		Fit:          FitContain,
 		Quality:      config.DefaultImageQuality,
 		WebpAccepted: webpAccepted,
+		Limits:       ImageLimits{MaxPixels: config.MaxPixels, MaxDimension: config.MaxImageDimension},
+		KeepMetadata: config.KeepVariantMetadata,
 	}
 
 	var err error
@@ -74,11 +105,29 @@ func createImageParams(imageID, options string, webpAccepted bool, config *Confi
 			if params.Quality, err = strconv.Atoi(val); err != nil {
 				return nil, fmt.Errorf("Quality should be integer")
 			}
+		case "gravity", "g":
+			switch val {
+			case GravityCentre, "center":
+				params.Gravity = ""
+				continue
+			case "attention":
+				val = GravitySmart
+			case "entropy":
+				return nil, fmt.Errorf("Entropy gravity is not supported, use smart instead")
+			}
+			if _, ok := bimgGravities[val]; !ok {
+				return nil, fmt.Errorf("Supported gravities are centre, north, south, east, west and smart")
+			}
+			params.Gravity = val
 		default:
 			return nil, fmt.Errorf("Invalid filter key: %s", key)
 		}
 	}
 
+	if params.Gravity != "" && params.Fit != FitCover {
+		return nil, fmt.Errorf("Gravity is only supported with fit=cover")
+	}
+
 	return params, nil
 }
 
@@ -98,6 +147,18 @@ func (params *ImageParams) getMd5() string {
 		params.Quality,
 		params.WebpAccepted,
 	)
+	if params.Tenant != "" {
+		// image ids are only unique in each tenant and
+		// the md5 is also used as id of conversion tasks
+		key = params.Tenant + "/" + key
+	}
+	if params.Gravity != "" {
+		// keeps the cache keys of centre gravity as they were before
+		key += ":" + params.Gravity
+	}
+	if params.usesFocalPoint() {
+		key += fmt.Sprintf(":%g,%g", params.FocalPoint.X, params.FocalPoint.Y)
+	}
 	h := md5.New()
 	_, err := io.WriteString(h, key)
 	if err != nil {
@@ -106,6 +167,13 @@ func (params *ImageParams) getMd5() string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// usesFocalPoint reports whether the image is cropped around its focal
+// point. Gravity of the request takes precedence over the focal point.
+func (params *ImageParams) usesFocalPoint() bool {
+	return params.FocalPoint != nil && params.Fit == FitCover && params.Gravity == "" &&
+		params.Width > 0 && params.Height > 0
+}
+
 func (params *ImageParams) getCachePath(dataDir string) string {
 	md5Sum := params.getMd5()
 	fileName := fmt.Sprintf("%s-%s", params.ImageID, md5Sum)
@@ -114,16 +182,34 @@ func (params *ImageParams) getCachePath(dataDir string) string {
 	return fmt.Sprintf("%s/%s", parentDir, fileName)
 }
 
+// orientedSize returns the dimensions of image after being
+// rotated according to its EXIF orientation.
+func orientedSize(metadata bimg.ImageMetadata) (int, int) {
+	width, height := metadata.Size.Width, metadata.Size.Height
+	if metadata.Orientation >= 5 && metadata.Orientation <= 8 {
+		// rotated by 90 or 270 degrees
+		return height, width
+	}
+	return width, height
+}
+
+// toBimgOptions takes the size of image after being rotated
+// according to its EXIF orientation which is done by libvips.
 func (params *ImageParams) toBimgOptions(size *bimg.ImageSize) *bimg.Options {
 	options := &bimg.Options{
-		Quality: params.Quality,
+		Quality:       params.Quality,
+		StripMetadata: !params.KeepMetadata.keepsAny(),
 	}
 
 	if params.Fit == FitCover {
 		options.Crop = true
 		options.Embed = true
+		options.Gravity = bimgGravities[params.Gravity]
 		options.Width = params.Width
 		options.Height = params.Height
+		if params.usesFocalPoint() {
+			params.setFocalPointCrop(options, size)
+		}
 	}
 	if params.Fit == FitContain || params.Fit == FitScaleDown {
 		if params.Width == 0 || params.Height == 0 {
@@ -158,6 +244,16 @@ func (params *ImageParams) toBimgOptions(size *bimg.ImageSize) *bimg.Options {
 	return options
 }
 
+//ConversionError is returned when libvips can not decode
+//or process the original image.
+type ConversionError struct {
+	Err error
+}
+
+func (e *ConversionError) Error() string {
+	return e.Err.Error()
+}
+
 func convert(inputPath, outputPath string, params *ImageParams) error {
 	f, err := os.Open(inputPath)
 	if err != nil {
@@ -171,23 +267,77 @@ func convert(inputPath, outputPath string, params *ImageParams) error {
 		return err
 	}
 
+	// dimensions are checked before libvips decodes the image
+	if params.Limits.enabled() {
+		width, height, err := readImageBufferSize(buffer.B)
+		if err != nil {
+			return &ConversionError{err}
+		}
+		if err := params.Limits.check(width, height); err != nil {
+			return &ConversionError{err}
+		}
+	}
+
 	img := bimg.NewImage(buffer.B)
-	size, err := img.Size()
+	metadata, err := img.Metadata()
 	if err != nil {
-		return err
+		return &ConversionError{err}
 	}
 
-	options := params.toBimgOptions(&size)
+	width, height := orientedSize(metadata)
+	options := params.toBimgOptions(&bimg.ImageSize{Width: width, Height: height})
+	setSRGBTransform(options, metadata, params.KeepMetadata)
 	newImage, err := img.Process(*options)
 	if err != nil {
-		return err
+		return &ConversionError{err}
+	}
+	if params.KeepMetadata.keepsAny() {
+		if newImage, err = stripMetadata(newImage, params.KeepMetadata); err != nil {
+			return &ConversionError{err}
+		}
 	}
 
 	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(outputPath, newImage, 0604); err != nil {
+	// cache file is written atomically, so that interrupted
+	// conversions do not leave half-written files behind.
+	tmpFile, err := ioutil.TempFile(filepath.Dir(outputPath), filepath.Base(outputPath)+".*"+tempFileSuffix)
+	if err != nil {
 		return err
 	}
-	return nil
+	_, err = tmpFile.Write(newImage)
+	if err == nil {
+		err = tmpFile.Chmod(0604)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), outputPath)
+}
+
+// tempFileSuffix is the suffix of the cache files which are being written
+const tempFileSuffix = ".tmp"
+
+// removeStaleTempFiles removes the temporary cache files which are
+// left behind when the server is killed during conversions.
+// It should be called before any conversion is started.
+func removeStaleTempFiles(dataDir string) error {
+	err := filepath.Walk(filepath.Join(dataDir, "caches"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && strings.HasSuffix(path, tempFileSuffix) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
 }
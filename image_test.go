@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/matryer/is"
 	bimg "gopkg.in/h2non/bimg.v1"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -48,6 +54,13 @@ func TestCachePath(t *testing.T) {
 		params.getCachePath("/tmp/media/"),
 		"/tmp/media/caches/5/00/NG4uQBa2f-c64dda22268336d2c246899c2bc79005",
 	)
+
+	// the same image id in another tenant is another image
+	params.Tenant = "blog"
+	blog := params.getMd5()
+	is.True(blog != "c64dda22268336d2c246899c2bc79005")
+	params.Tenant = "shop"
+	is.True(params.getMd5() != blog)
 }
 
 func TestGetParamsFromUri(t *testing.T) {
@@ -225,6 +238,77 @@ func TestGetParamsFromUri(t *testing.T) {
 			},
 			err: fmt.Errorf("Quality should be integer"),
 		},
+		{
+			testID:       18,
+			imageID:      "NG4uQBa2f",
+			options:      "w=300,h=300,fit=cover,gravity=north",
+			webpAccepted: true,
+			expectedParams: &ImageParams{
+				ImageID:      "NG4uQBa2f",
+				Fit:          "cover",
+				Width:        300,
+				Height:       300,
+				Quality:      50,
+				Gravity:      "north",
+				WebpAccepted: true,
+			},
+			err: nil,
+		},
+		{
+			testID:       19,
+			imageID:      "NG4uQBa2f",
+			options:      "w=300,h=300,fit=cover,g=attention",
+			webpAccepted: true,
+			expectedParams: &ImageParams{
+				ImageID:      "NG4uQBa2f",
+				Fit:          "cover",
+				Width:        300,
+				Height:       300,
+				Quality:      50,
+				Gravity:      "smart",
+				WebpAccepted: true,
+			},
+			err: nil,
+		},
+		{
+			testID:       20,
+			imageID:      "NG4uQBa2f",
+			options:      "w=300,h=300,fit=cover,gravity=center",
+			webpAccepted: true,
+			expectedParams: &ImageParams{
+				ImageID:      "NG4uQBa2f",
+				Fit:          "cover",
+				Width:        300,
+				Height:       300,
+				Quality:      50,
+				WebpAccepted: true,
+			},
+			err: nil,
+		},
+		{
+			testID:         21,
+			imageID:        "NG4uQBa2f",
+			options:        "w=300,h=300,fit=cover,gravity=top",
+			webpAccepted:   true,
+			expectedParams: &ImageParams{},
+			err:            fmt.Errorf("Supported gravities are centre, north, south, east, west and smart"),
+		},
+		{
+			testID:         22,
+			imageID:        "NG4uQBa2f",
+			options:        "w=300,h=300,fit=cover,gravity=entropy",
+			webpAccepted:   true,
+			expectedParams: &ImageParams{},
+			err:            fmt.Errorf("Entropy gravity is not supported, use smart instead"),
+		},
+		{
+			testID:         23,
+			imageID:        "NG4uQBa2f",
+			options:        "w=300,h=300,gravity=smart",
+			webpAccepted:   true,
+			expectedParams: &ImageParams{},
+			err:            fmt.Errorf("Gravity is only supported with fit=cover"),
+		},
 	}
 
 	for _, tc := range tt {
@@ -472,3 +556,176 @@ func TestGetParamsToBimgOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestConvertChecksImageLimits(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	params := &ImageParams{
+		ImageID: "NG4uQBa2f",
+		Width:   100,
+		Height:  100,
+		Fit:     FitCover,
+		Limits:  ImageLimits{MaxPixels: 100000000},
+	}
+	err = convert(testFileBomb, filepath.Join(dir, "output"), params)
+	is.Equal(err, &ConversionError{
+		fmt.Errorf("Image dimensions 50000x50000 exceed the maximum of 100000000 pixels."),
+	})
+	_, err = os.Stat(filepath.Join(dir, "output"))
+	is.True(os.IsNotExist(err))
+}
+
+func TestOrientedSize(t *testing.T) {
+	testCases := []struct {
+		orientation int
+		width       int
+		height      int
+	}{
+		{orientation: 0, width: 300, height: 200},
+		{orientation: 1, width: 300, height: 200},
+		{orientation: 3, width: 300, height: 200},
+		{orientation: 5, width: 200, height: 300},
+		{orientation: 6, width: 200, height: 300},
+		{orientation: 8, width: 200, height: 300},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(fmt.Sprintf("orientation_%d", tc.orientation), func(t *testing.T) {
+			is := is.New(t)
+			metadata := bimg.ImageMetadata{
+				Size:        bimg.ImageSize{Width: 300, Height: 200},
+				Orientation: tc.orientation,
+			}
+			width, height := orientedSize(metadata)
+			is.Equal(width, tc.width)
+			is.Equal(height, tc.height)
+		})
+	}
+}
+
+func TestGravityToBimgOptions(t *testing.T) {
+	size := &bimg.ImageSize{Width: 900, Height: 800}
+	tt := []struct {
+		gravity string
+		options bimg.Gravity
+	}{
+		{"", bimg.GravityCentre},
+		{GravityNorth, bimg.GravityNorth},
+		{GravitySouth, bimg.GravitySouth},
+		{GravityEast, bimg.GravityEast},
+		{GravityWest, bimg.GravityWest},
+		{GravitySmart, bimg.GravitySmart},
+	}
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.gravity, func(t *testing.T) {
+			is := is.New(t)
+			params := &ImageParams{Width: 300, Height: 300, Fit: FitCover, Gravity: tc.gravity}
+			is.Equal(params.toBimgOptions(size).Gravity, tc.options)
+		})
+	}
+}
+
+func TestGravityChangesCacheKey(t *testing.T) {
+	is := is.New(t)
+	params := &ImageParams{ImageID: "NG4uQBa2f", Width: 300, Height: 300, Fit: FitCover}
+	centre := params.getMd5()
+	params.Gravity = GravitySmart
+	is.True(params.getMd5() != centre)
+}
+
+func TestToBimgOptionsStripsMetadata(t *testing.T) {
+	is := is.New(t)
+	size := &bimg.ImageSize{Width: 900, Height: 800}
+	params := &ImageParams{Width: 300, Height: 300, Fit: FitCover}
+	is.True(params.toBimgOptions(size).StripMetadata)
+
+	// metadata is stripped by stripMetadata when something should be kept
+	params.KeepMetadata = MetadataOptions{ICCProfile: true}
+	is.True(!params.toBimgOptions(size).StripMetadata)
+}
+
+func TestRemoveStaleTempFiles(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	// data directory without caches
+	is.NoErr(removeStaleTempFiles(dir))
+
+	cacheDir := filepath.Join(dir, "caches", "5", "00")
+	is.NoErr(os.MkdirAll(cacheDir, 0755))
+	cacheFile := filepath.Join(cacheDir, "c64dda22268336d2c246899c2bc79005")
+	stale := cacheFile + ".123456" + tempFileSuffix
+	is.NoErr(ioutil.WriteFile(cacheFile, []byte("image"), 0604))
+	is.NoErr(ioutil.WriteFile(stale, []byte("half"), 0604))
+
+	is.NoErr(removeStaleTempFiles(dir))
+	_, err = os.Stat(stale)
+	is.True(os.IsNotExist(err))
+	_, err = os.Stat(cacheFile)
+	is.NoErr(err)
+}
+
+func TestConvertRotatedImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	profile, err := ioutil.ReadFile(testFileProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keep := range []MetadataOptions{{}, {ICCProfile: true}} {
+		keep := keep
+		t.Run(fmt.Sprintf("keep_icc_%t", keep.ICCProfile), func(t *testing.T) {
+			is := is.New(t)
+			params := &ImageParams{
+				ImageID:      "NG4uQBa2f",
+				Width:        100,
+				Height:       300,
+				Fit:          FitContain,
+				Quality:      90,
+				KeepMetadata: keep,
+			}
+			outputPath := filepath.Join(dir, "output")
+			is.NoErr(convert(testFileRotated, outputPath, params))
+			output, err := ioutil.ReadFile(outputPath)
+			is.NoErr(err)
+
+			// 300x200 image with orientation 6 is displayed as 200x300
+			img, err := jpeg.Decode(bytes.NewReader(output))
+			is.NoErr(err)
+			is.Equal(img.Bounds().Size(), image.Pt(100, 150))
+
+			// red top-left corner is rotated to top-right. The fixture
+			// has a profile with swapped red and blue primaries, so its
+			// pixels are only red and blue if they are converted to sRGB.
+			topRight, bottomLeft := image.Pt(90, 10), image.Pt(10, 140)
+			if keep.ICCProfile {
+				// the profile is kept and the pixels are not converted
+				is.True(bytes.Contains(output, profile))
+				topRight, bottomLeft = bottomLeft, topRight
+			} else {
+				is.True(!bytes.Contains(output, iccProfileHeader))
+			}
+			r, _, b, _ := img.At(topRight.X, topRight.Y).RGBA()
+			is.True(r > b)
+			r, _, b, _ = img.At(bottomLeft.X, bottomLeft.Y).RGBA()
+			is.True(b > r)
+
+			// orientation and GPS location are not kept
+			is.True(!bytes.Contains(output, exifHeader))
+			metadata, err := bimg.Metadata(output)
+			is.NoErr(err)
+			is.Equal(metadata.Orientation, 0)
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//ImageInfo holds the custom metadata, tags and visibility of an uploaded
+//image. It is stored in a sidecar json file next to the original image.
+type ImageInfo struct {
+	ImageID    string            `json:"image_id"`
+	Metadata   map[string]string `json:"metadata"`
+	Tags       []string          `json:"tags"`
+	Private    bool              `json:"private"`
+	FocalPoint *FocalPoint       `json:"focal_point,omitempty"`
+}
+
+//ImageInfoUpdate is the body of info update requests.
+//Omitted fields are left untouched.
+type ImageInfoUpdate struct {
+	Metadata   *map[string]string `json:"metadata"`
+	Tags       *[]string          `json:"tags"`
+	Private    *bool              `json:"private"`
+	FocalPoint FocalPointUpdate   `json:"focal_point"`
+}
+
+func newImageInfo(imageID string) *ImageInfo {
+	return &ImageInfo{
+		ImageID:  imageID,
+		Metadata: map[string]string{},
+		Tags:     []string{},
+	}
+}
+
+func getInfoPathFromImageID(dataDir string, imageID string) string {
+	return getFilePathFromImageID(dataDir, imageID) + ".json"
+}
+
+func parseTags(tags string) []string {
+	result := []string{}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// normalize replaces nil fields with empty values so they
+// are encoded as {} and [] instead of null.
+func (info *ImageInfo) normalize() {
+	if info.Metadata == nil {
+		info.Metadata = map[string]string{}
+	}
+	if info.Tags == nil {
+		info.Tags = []string{}
+	}
+}
+
+func (info *ImageInfo) update(u *ImageInfoUpdate) {
+	if u.Metadata != nil {
+		info.Metadata = *u.Metadata
+	}
+	if u.Tags != nil {
+		info.Tags = *u.Tags
+	}
+	if u.Private != nil {
+		info.Private = *u.Private
+	}
+	if u.FocalPoint.Set {
+		info.FocalPoint = u.FocalPoint.Value
+	}
+	info.normalize()
+}
+
+func (info *ImageInfo) hasTag(tag string) bool {
+	for _, t := range info.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether info has all the given tags and
+// all the given metadata key/value pairs.
+func (info *ImageInfo) matches(tags []string, metadata map[string]string) bool {
+	for _, tag := range tags {
+		if !info.hasTag(tag) {
+			return false
+		}
+	}
+	for key, val := range metadata {
+		if v, ok := info.Metadata[key]; !ok || v != val {
+			return false
+		}
+	}
+	return true
+}
+
+// readImageInfo loads the sidecar file of the image. Images which are
+// uploaded without metadata have no sidecar file and an empty info is
+// returned for them.
+func readImageInfo(dataDir string, imageID string) (*ImageInfo, error) {
+	info := newImageInfo(imageID)
+	buf, err := ioutil.ReadFile(getInfoPathFromImageID(dataDir, imageID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return info, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, info); err != nil {
+		return nil, fmt.Errorf("Invalid info file of image %s: %v", imageID, err)
+	}
+	info.normalize()
+	return info, nil
+}
+
+// writeImageInfo stores info in a temporary file and then renames it
+// so readers never see a partially written sidecar.
+func writeImageInfo(dataDir string, info *ImageInfo) error {
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	infoPath := getInfoPathFromImageID(dataDir, info.ImageID)
+	tmpPath := infoPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, infoPath)
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+//ImageList is the response body of list api. Next is the
+//cursor of the next page which is empty on the last page.
+type ImageList struct {
+	Images []*ImageInfo `json:"images"`
+	Next   string       `json:"next,omitempty"`
+}
+
+// listImageInfos walks the images directory and returns info of at
+// most limit images which match the given tags and metadata, ordered
+// by image id and starting after the given one. Walking only reads the
+// directories and info files are read until the page is full, but the
+// cost still grows with the number of images.
+func listImageInfos(dataDir string, tags []string, metadata map[string]string, after string, limit int) (*ImageList, error) {
+	imageIDs := []string{}
+	imagesDir := filepath.Join(dataDir, "images")
+	err := filepath.Walk(imagesDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() && ImageIDRegex.MatchString(fi.Name()) && fi.Name() > after {
+			imageIDs = append(imageIDs, fi.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(imageIDs)
+
+	list := &ImageList{Images: []*ImageInfo{}}
+	for i, imageID := range imageIDs {
+		info, err := readImageInfo(dataDir, imageID)
+		if err != nil {
+			return nil, err
+		}
+		if !info.matches(tags, metadata) {
+			continue
+		}
+		list.Images = append(list.Images, info)
+		if len(list.Images) == limit {
+			if i < len(imageIDs)-1 {
+				list.Next = imageID
+			}
+			break
+		}
+	}
+	return list, nil
+}
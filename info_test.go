@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParseTags(t *testing.T) {
+	is := is.New(t)
+	is.Equal(parseTags(""), []string{})
+	is.Equal(parseTags("cat"), []string{"cat"})
+	is.Equal(parseTags(" cat, ,animal ,"), []string{"cat", "animal"})
+}
+
+func TestImageInfoMatches(t *testing.T) {
+	info := &ImageInfo{
+		ImageID:  "NG4uQBa2f",
+		Metadata: map[string]string{"owner": "blog", "source": "camera"},
+		Tags:     []string{"cat", "animal"},
+	}
+
+	tt := []struct {
+		tags     []string
+		metadata map[string]string
+		expected bool
+	}{
+		{nil, nil, true},
+		{[]string{"cat"}, nil, true},
+		{[]string{"cat", "animal"}, nil, true},
+		{[]string{"cat", "dog"}, nil, false},
+		{nil, map[string]string{"owner": "blog"}, true},
+		{nil, map[string]string{"owner": "shop"}, false},
+		{nil, map[string]string{"alt": ""}, false},
+		{[]string{"animal"}, map[string]string{"owner": "blog", "source": "camera"}, true},
+	}
+
+	for i, tc := range tt {
+		t.Run(fmt.Sprintf("ImageInfoMatches %d", i), func(t *testing.T) {
+			is := is.NewRelaxed(t)
+			is.Equal(info.matches(tc.tags, tc.metadata), tc.expected)
+		})
+	}
+}
+
+func TestImageInfoUpdate(t *testing.T) {
+	is := is.New(t)
+	info := newImageInfo("NG4uQBa2f")
+	metadata := map[string]string{"owner": "blog"}
+	info.update(&ImageInfoUpdate{Metadata: &metadata})
+	is.Equal(info.Metadata, metadata)
+	is.Equal(info.Tags, []string{})
+
+	var tags []string
+	info.update(&ImageInfoUpdate{Tags: &tags})
+	is.Equal(info.Metadata, metadata)
+	is.Equal(info.Tags, []string{})
+
+	focalPoint := &FocalPoint{X: 0.2, Y: 0.8}
+	info.update(&ImageInfoUpdate{FocalPoint: FocalPointUpdate{Set: true, Value: focalPoint}})
+	is.Equal(info.FocalPoint, focalPoint)
+	info.update(&ImageInfoUpdate{})
+	is.Equal(info.FocalPoint, focalPoint)
+	info.update(&ImageInfoUpdate{FocalPoint: FocalPointUpdate{Set: true}})
+	is.True(info.FocalPoint == nil)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// unixSocketPrefix is the prefix of server addresses
+// which are paths of unix domain sockets.
+const unixSocketPrefix = "unix:"
+
+// systemdListenFDsStart is the first file descriptor
+// passed by systemd socket activation.
+const systemdListenFDsStart = 3
+
+func unixSocketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, unixSocketPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(address, unixSocketPrefix), true
+}
+
+func parseSocketMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("Unix socket mode %s is not valid. Try use 0660 format.", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// createListener returns the listener inherited from systemd if the
+// server is started by socket activation. Otherwise it listens on
+// server address which is either ip:port or unix:/path/of/socket.
+func createListener(address string, socketMode os.FileMode) (net.Listener, error) {
+	ln, err := systemdListener()
+	if ln != nil || err != nil {
+		return ln, err
+	}
+	path, ok := unixSocketPath(address)
+	if !ok {
+		return net.Listen("tcp4", address)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	// socket file is created with its final permission by umask, so
+	// that clients can not connect while it has a looser permission.
+	umask := syscall.Umask(int(0777 &^ socketMode))
+	ln, err = net.Listen("unix", path)
+	syscall.Umask(umask)
+	return ln, err
+}
+
+// removeStaleSocket removes the socket file which is left from a
+// previous run. Other types of files are not touched.
+func removeStaleSocket(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if stat.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("Could not listen on %s. File exists and is not a socket.", path)
+	}
+	return os.Remove(path)
+}
+
+// systemdListener returns the socket passed by systemd according to
+// LISTEN_PID and LISTEN_FDS environment variables or nil if there is
+// no such socket.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds == 0 {
+		return nil, nil
+	}
+	if fds > 1 {
+		return nil, fmt.Errorf("Expected one socket from systemd but got %d.", fds)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	syscall.CloseOnExec(systemdListenFDsStart)
+	file := os.NewFile(systemdListenFDsStart, "systemd-socket")
+	defer file.Close()
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not use the socket from systemd: %v", err)
+	}
+	return ln, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestCreateListenerUnixSocket(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "webp_server_socket")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webp.sock")
+
+	// socket gets its mode regardless of umask which is restored afterwards
+	umask := syscall.Umask(0)
+	defer syscall.Umask(umask)
+	ln, err := createListener("unix:"+path, 0660)
+	is.NoErr(err)
+	is.Equal(syscall.Umask(0), 0)
+	stat, err := os.Stat(path)
+	is.NoErr(err)
+	is.Equal(stat.Mode()&os.ModePerm, os.FileMode(0660))
+	is.True(stat.Mode()&os.ModeSocket != 0)
+
+	go func(ln net.Listener) {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}(ln)
+	conn, err := net.Dial("unix", path)
+	is.NoErr(err)
+	conn.Close()
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	// stale socket of the previous run is replaced
+	ln, err = createListener("unix:"+path, 0600)
+	is.NoErr(err)
+	ln.Close()
+
+	// regular files are not removed
+	filePath := filepath.Join(dir, "file")
+	is.NoErr(ioutil.WriteFile(filePath, []byte("data"), 0644))
+	_, err = createListener("unix:"+filePath, 0600)
+	is.True(err != nil)
+	_, err = os.Stat(filePath)
+	is.NoErr(err)
+}
+
+func TestCreateListenerTCP(t *testing.T) {
+	is := is.New(t)
+	ln, err := createListener("127.0.0.1:0", 0660)
+	is.NoErr(err)
+	is.Equal(ln.Addr().Network(), "tcp")
+	ln.Close()
+}
+
+func TestSystemdListenerIsIgnoredForOtherProcesses(t *testing.T) {
+	is := is.New(t)
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	ln, err := systemdListener()
+	is.NoErr(err)
+	is.True(ln == nil)
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "2")
+	_, err = systemdListener()
+	is.True(err != nil)
+}
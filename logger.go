@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Level is the severity of log entries
+type Level int
+
+const (
+	//LevelDebug is used for verbose messages
+	LevelDebug Level = iota
+	//LevelInfo is used for normal operations
+	LevelInfo
+	//LevelWarn is used for unexpected but handled situations
+	LevelWarn
+	//LevelError is used for failures
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+var validLogFormats = []string{"text", "json", "logfmt"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func parseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Log level %s is not valid. Valid levels are debug, info, warn and error.", name)
+}
+
+func validateLogFormat(format string) error {
+	for _, f := range validLogFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("Log format %s is not valid. Valid formats are text, json and logfmt.", format)
+}
+
+//Logger writes leveled log entries with key value fields in text,
+//json or logfmt format to stdout or a log file.
+type Logger struct {
+	level  Level
+	format string
+	path   string
+	out    io.Writer
+	file   *os.File
+	sync.Mutex
+}
+
+// logger is the logger of the whole server. It logs to stdout
+// until it is configured.
+var logger = &Logger{level: LevelInfo, format: "text", out: os.Stdout}
+
+// Configure sets the level and format of logger and directs the logs
+// to the given path or stdout if the path is empty.
+func (l *Logger) Configure(path string, level string, format string) error {
+	lvl, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	if err := validateLogFormat(format); err != nil {
+		return err
+	}
+	file, err := openLog(path)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.closeFile()
+	l.level, l.format, l.path = lvl, format, path
+	l.setFile(file)
+	return nil
+}
+
+// Reopen opens the log file again. It is used after the file is
+// rotated by logrotate.
+func (l *Logger) Reopen() error {
+	l.Lock()
+	path := l.path
+	l.Unlock()
+	if path == "" {
+		return nil
+	}
+	file, err := openLog(path)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.closeFile()
+	l.setFile(file)
+	return nil
+}
+
+// Close closes the log file and directs the logs to stdout
+func (l *Logger) Close() {
+	l.Lock()
+	defer l.Unlock()
+	l.closeFile()
+	l.path = ""
+	l.setFile(nil)
+}
+
+// setOutput directs the logs to the writer. It is used in tests.
+func (l *Logger) setOutput(out io.Writer) {
+	l.Lock()
+	defer l.Unlock()
+	l.out = out
+}
+
+func (l *Logger) setFile(file *os.File) {
+	l.file = file
+	if file == nil {
+		l.out = os.Stdout
+	} else {
+		l.out = file
+	}
+}
+
+func (l *Logger) closeFile() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// openLog opens the log file in append mode
+// or returns nil if log path is not set.
+func openLog(logPath string) (*os.File, error) {
+	if logPath == "" {
+		return nil, nil
+	}
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open log file: %v", err)
+	}
+	return logFile, nil
+}
+
+//Debug logs the message and key value pairs in debug level
+func (l *Logger) Debug(msg string, keyValues ...interface{}) {
+	l.log(LevelDebug, msg, keyValues)
+}
+
+//Info logs the message and key value pairs in info level
+func (l *Logger) Info(msg string, keyValues ...interface{}) {
+	l.log(LevelInfo, msg, keyValues)
+}
+
+//Warn logs the message and key value pairs in warn level
+func (l *Logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(LevelWarn, msg, keyValues)
+}
+
+//Error logs the message and key value pairs in error level
+func (l *Logger) Error(msg string, keyValues ...interface{}) {
+	l.log(LevelError, msg, keyValues)
+}
+
+//Printf logs the formatted message in error level. It makes
+//logger usable as fasthttp.Logger.
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.log(LevelError, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) log(level Level, msg string, keyValues []interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	if level < l.level {
+		return
+	}
+	var buf bytes.Buffer
+	now := time.Now()
+	switch l.format {
+	case "json":
+		writeJSONEntry(&buf, now, level, msg, keyValues)
+	case "logfmt":
+		writeLogfmtEntry(&buf, now, level, msg, keyValues)
+	default:
+		writeTextEntry(&buf, now, level, msg, keyValues)
+	}
+	buf.WriteByte('\n')
+	l.out.Write(buf.Bytes())
+}
+
+// fieldValue converts values of fields to strings
+func fieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// quoteIfNeeded quotes the values which contain spaces,
+// quotes or equal signs.
+func quoteIfNeeded(value string) string {
+	if value == "" || strings.ContainsAny(value, " \"=\t\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func writeFields(buf *bytes.Buffer, keyValues []interface{}) {
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		fmt.Fprintf(buf, " %v=%s", keyValues[i], quoteIfNeeded(fieldValue(keyValues[i+1])))
+	}
+}
+
+func writeTextEntry(buf *bytes.Buffer, now time.Time, level Level, msg string, keyValues []interface{}) {
+	buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+	buf.WriteString(strings.ToUpper(level.String()))
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	writeFields(buf, keyValues)
+}
+
+func writeLogfmtEntry(buf *bytes.Buffer, now time.Time, level Level, msg string, keyValues []interface{}) {
+	buf.WriteString("time=")
+	buf.WriteString(now.Format(time.RFC3339))
+	buf.WriteString(" level=")
+	buf.WriteString(level.String())
+	buf.WriteString(" msg=")
+	buf.WriteString(quoteIfNeeded(msg))
+	writeFields(buf, keyValues)
+}
+
+func writeJSONEntry(buf *bytes.Buffer, now time.Time, level Level, msg string, keyValues []interface{}) {
+	writePair := func(key string, value interface{}) {
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('{')
+	writePair("time", now.Format(time.RFC3339))
+	buf.WriteByte(',')
+	writePair("level", level.String())
+	buf.WriteByte(',')
+	writePair("msg", msg)
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		buf.WriteByte(',')
+		value := keyValues[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writePair(fmt.Sprint(keyValues[i]), value)
+	}
+	buf.WriteByte('}')
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestLoggerFormats(t *testing.T) {
+	tt := []struct {
+		format   string
+		expected *regexp.Regexp
+	}{
+		{
+			format:   "text",
+			expected: regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d INFO Image uploaded image=abc token="my token" size=12\n$`),
+		},
+		{
+			format:   "logfmt",
+			expected: regexp.MustCompile(`^time=\S+ level=info msg="Image uploaded" image=abc token="my token" size=12\n$`),
+		},
+		{
+			format:   "json",
+			expected: regexp.MustCompile(`^\{"time":"\S+","level":"info","msg":"Image uploaded","image":"abc","token":"my token","size":12\}\n$`),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.format, func(t *testing.T) {
+			is := is.NewRelaxed(t)
+			buf := &bytes.Buffer{}
+			l := &Logger{level: LevelInfo, format: tc.format, out: buf}
+			l.Info("Image uploaded", "image", "abc", "token", "my token", "size", 12)
+			is.True(tc.expected.Match(buf.Bytes()))
+		})
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	is := is.New(t)
+	buf := &bytes.Buffer{}
+	l := &Logger{level: LevelWarn, format: "json", out: buf}
+	l.Debug("debug")
+	l.Info("info")
+	is.Equal(buf.Len(), 0)
+	l.Warn("warn")
+	l.Error("error", "error", os.ErrNotExist)
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	is.Equal(len(lines), 2)
+	entry := map[string]string{}
+	is.NoErr(json.Unmarshal(lines[1], &entry))
+	is.Equal(entry["level"], "error")
+	is.Equal(entry["error"], "file does not exist")
+}
+
+func TestLoggerReopen(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "webp_server_log")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "webp-server.log")
+
+	l := &Logger{out: os.Stdout}
+	is.True(l.Configure(logPath, "verbose", "text") != nil)
+	is.True(l.Configure(logPath, "info", "xml") != nil)
+	is.NoErr(l.Configure(logPath, "info", "logfmt"))
+	defer l.Close()
+	l.Info("first")
+
+	// simulate logrotate
+	is.NoErr(os.Rename(logPath, logPath+".1"))
+	l.Info("second")
+	is.NoErr(l.Reopen())
+	l.Info("third")
+
+	rotated, err := ioutil.ReadFile(logPath + ".1")
+	is.NoErr(err)
+	is.Equal(bytes.Count(rotated, []byte("\n")), 2)
+	current, err := ioutil.ReadFile(logPath)
+	is.NoErr(err)
+	is.True(bytes.Contains(current, []byte("msg=third")))
+}
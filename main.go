@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	bimg "gopkg.in/h2non/bimg.v1"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
 )
 
 func checkVipsVersion(majorVersion, minorVersion int) error {
@@ -27,53 +32,187 @@ func runServer(ctx context.Context) error {
 	}
 	configPath := flag.String("config", "", "Path of config file in yml format")
 	flag.Parse()
-	if *configPath == "" {
-		return fmt.Errorf("Set config.yml path via -config flag.")
+	if _, ok := os.LookupEnv(envPrefix + "DATA_DIRECTORY"); *configPath == "" && !ok {
+		return fmt.Errorf("Set config.yml path via -config flag or WEBP_SERVER_* environment variables.")
 	}
-	file, err := os.Open(*configPath)
+	config, err := loadConfig(*configPath)
 	if err != nil {
-		return fmt.Errorf("Error loading config: %v", err)
+		return err
 	}
-	config, err := parseConfig(file)
-	file.Close()
-	if err != nil {
+	if err := logger.Configure(config.LogPath, config.LogLevel, config.LogFormat); err != nil {
 		return err
 	}
-	if config.LogPath != "" {
-		logFile, err := os.OpenFile(config.LogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
-		if err != nil {
-			return fmt.Errorf("Could not open log file: %v", err)
+	defer logger.Close()
+
+	// conversions of the previous run may have been killed
+	dataDirs := []string{config.DataDir}
+	for _, tenant := range config.Tenants {
+		dataDirs = append(dataDirs, tenant.DataDir)
+	}
+	for _, dataDir := range dataDirs {
+		if err := removeStaleTempFiles(dataDir); err != nil {
+			return err
 		}
-		defer logFile.Close()
-		log.SetOutput(logFile)
-	} else {
-		log.SetOutput(os.Stdout)
 	}
 
-	server := createServer(config)
+	var certReloader *CertReloader
+	if config.TLSCertFile != "" {
+		if certReloader, err = NewCertReloader(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			return err
+		}
+	}
+
+	handler := newHandler(config)
+	server := handler.createServer()
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
 	defer close(done)
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	reopenLog := make(chan os.Signal, 1)
+	signal.Notify(reopenLog, syscall.SIGUSR1)
+	defer signal.Stop(reopenLog)
+
 	serverErr := make(chan error)
 	defer close(serverErr)
 
+	socketMode, _ := parseSocketMode(config.UnixSocketMode)
+	ln, err := createListener(config.ServerAddress, socketMode)
+	if err != nil {
+		return err
+	}
+	if certReloader != nil {
+		ln = tls.NewListener(ln, certReloader.TLSConfig())
+	}
+
 	go func() {
-		log.Printf("Starting server on %s", config.ServerAddress)
-		if err := server.ListenAndServe(config.ServerAddress); err != nil {
+		logger.Info("Starting server", "network", ln.Addr().Network(), "address", ln.Addr().String())
+		if err := server.Serve(ln); err != nil {
 			serverErr <- err
 		}
 	}()
 
+	for {
+		select {
+		case <-reload:
+			newConfig, err := reloadConfig(*configPath, handler, config)
+			if err != nil {
+				logger.Error("Config is not reloaded", "error", err)
+			} else {
+				if err := logger.Configure(newConfig.LogPath, newConfig.LogLevel, newConfig.LogFormat); err != nil {
+					logger.Error("Could not configure logger", "error", err)
+				}
+				config = newConfig
+				logger.Info("Config reloaded", "path", *configPath)
+			}
+			if certReloader != nil {
+				if err := certReloader.Reload(); err != nil {
+					logger.Error("Could not reload TLS certificate", "error", err)
+				} else {
+					logger.Info("TLS certificate reloaded", "path", config.TLSCertFile)
+				}
+			}
+		case <-reopenLog:
+			if err := logger.Reopen(); err != nil {
+				logger.Error("Could not reopen log file", "error", err)
+			}
+		case <-done:
+			return shutdown(server, handler, config)
+		case <-ctx.Done():
+			return shutdown(server, handler, config)
+		case err := <-serverErr:
+			return err
+		}
+	}
+}
+
+// shutdown stops accepting new connections and conversions and waits
+// for the ongoing ones until shutdown timeout. Conversions which are
+// not finished until then are abandoned and reported in logs.
+func shutdown(server *fasthttp.Server, handler *Handler, config *Config) error {
+	timeout := time.Duration(config.ShutdownTimeout) * time.Second
+	deadline := time.Now().Add(timeout)
+	logger.Info("Shutting down server", "timeout", timeout.String())
+
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.Shutdown()
+	}()
+
+	abandoned := handler.TaskManager.Shutdown(timeout)
+	if len(abandoned) != 0 {
+		logger.Warn(
+			"Conversions abandoned on shutdown",
+			"count", len(abandoned),
+			"tasks", strings.Join(abandoned, ","),
+		)
+	}
+
 	select {
-	case <-done:
-		return server.Shutdown()
-	case <-ctx.Done():
-		return server.Shutdown()
-	case err := <-serverErr:
+	case err := <-serverDone:
 		return err
+	case <-time.After(time.Until(deadline)):
+		return fmt.Errorf("Server did not shut down in %s", timeout)
+	}
+}
+
+// loadConfig parses the config file. If the path is empty,
+// config is only read from environment variables.
+func loadConfig(configPath string) (*Config, error) {
+	if configPath == "" {
+		return parseConfig(strings.NewReader(""))
+	}
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading config: %v", err)
+	}
+	defer file.Close()
+	return parseConfig(file)
+}
+
+// reloadConfig parses the config file again and applies it to the
+// handler. If the new config is invalid, the current one is kept.
+func reloadConfig(configPath string, handler *Handler, current *Config) (*Config, error) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := handler.Reload(config); err != nil {
+		return nil, err
+	}
+	for _, name := range restartRequiredChanges(current, config) {
+		logger.Warn("Config change requires restarting the server", "key", name)
+	}
+	return config, nil
+}
+
+// restartRequiredChanges returns the config keys which have been
+// changed but are only applied when the server is started.
+func restartRequiredChanges(current *Config, config *Config) []string {
+	var changes []string
+	if current.ServerAddress != config.ServerAddress {
+		changes = append(changes, "server_address")
+	}
+	if current.UnixSocketMode != config.UnixSocketMode {
+		changes = append(changes, "unix_socket_mode")
+	}
+	if current.TLSCertFile != config.TLSCertFile || current.TLSKeyFile != config.TLSKeyFile {
+		changes = append(changes, "tls_cert_file and tls_key_file")
+	}
+	if current.ConvertConcurrency != config.ConvertConcurrency {
+		changes = append(changes, "convert_concurrency")
+	}
+	if current.ReservedWorkers != config.ReservedWorkers {
+		changes = append(changes, "reserved_interactive_workers")
+	}
+	if maxRequestBodySize(config) > maxRequestBodySize(current) {
+		changes = append(changes, "max_uploaded_image_size")
 	}
+	return changes
 }
 
 func main() {
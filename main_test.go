@@ -53,6 +53,24 @@ func TestCheckVersion(t *testing.T) {
 	}
 }
 
+func TestRestartRequiredChanges(t *testing.T) {
+	is := is.New(t)
+	current := getDefaultConfig()
+	config := getDefaultConfig()
+	config.ValidImageSizes = []string{"800x600"}
+	config.MaxUploadedImageSize = 2
+	is.Equal(len(restartRequiredChanges(current, config)), 0)
+
+	config.ServerAddress = "127.0.0.1:9000"
+	config.ConvertConcurrency = current.ConvertConcurrency + 1
+	config.ReservedWorkers = 1
+	config.MaxUploadedImageSize = 8
+	is.Equal(
+		restartRequiredChanges(current, config),
+		[]string{"server_address", "convert_concurrency", "reserved_interactive_workers", "max_uploaded_image_size"},
+	)
+}
+
 func TestRunServerInvalidConfigFlag(t *testing.T) {
 	is := is.New(t)
 	ctx := context.Background()
@@ -61,7 +79,7 @@ func TestRunServerInvalidConfigFlag(t *testing.T) {
 		cancel()
 	})
 	err := runServer(ctx)
-	is.Equal(err, fmt.Errorf("Set config.yml path via -config flag."))
+	is.Equal(err, fmt.Errorf("Set config.yml path via -config flag or WEBP_SERVER_* environment variables."))
 	flag.CommandLine = flag.NewFlagSet("config", flag.ExitOnError)
 	configPath := "/tmp/webpserver_test.yaml"
 	os.Remove(configPath)
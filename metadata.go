@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+//MetadataOptions tells which metadata of images are kept
+//when the other metadata like EXIF and XMP are stripped.
+type MetadataOptions struct {
+	ICCProfile bool `yaml:"icc_profile"`
+	Copyright  bool `yaml:"copyright"`
+}
+
+// keepsAny reports whether any metadata should be kept. libvips strips
+// all the metadata including ICC profile, so images which need to keep
+// something are stripped by stripMetadata instead.
+func (keep MetadataOptions) keepsAny() bool {
+	return keep.ICCProfile || keep.Copyright
+}
+
+const (
+	exifCopyrightTag = 0x8298
+	exifASCIIType    = 2
+)
+
+var (
+	exifHeader       = []byte("Exif\x00\x00")
+	iccProfileHeader = []byte("ICC_PROFILE\x00")
+	pngSignature     = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// stripMetadata removes EXIF, XMP, IPTC, comments and text metadata
+// from jpeg, png and webp images except the ICC profile and copyright
+// notice if they should be kept. Other formats are returned as is.
+func stripMetadata(buf []byte, keep MetadataOptions) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(buf, []byte{0xff, 0xd8}):
+		return stripJPEGMetadata(buf, keep)
+	case bytes.HasPrefix(buf, pngSignature):
+		return stripPNGMetadata(buf, keep)
+	case len(buf) >= 16 && string(buf[0:4]) == "RIFF" && string(buf[8:12]) == "WEBP":
+		return stripWebpMetadata(buf, keep)
+	}
+	return buf, nil
+}
+
+// exifCopyright returns the copyright of IFD0 of the tiff
+// structure of EXIF data or an empty string if there is none.
+func exifCopyright(tiff []byte) string {
+	tiff = bytes.TrimPrefix(tiff, exifHeader)
+	if len(tiff) < 8 {
+		return ""
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return ""
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) || ifd < 8 {
+		return ""
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return ""
+		}
+		if order.Uint16(tiff[entry:]) != exifCopyrightTag || order.Uint16(tiff[entry+2:]) != exifASCIIType {
+			continue
+		}
+		count := int(order.Uint32(tiff[entry+4:]))
+		offset := entry + 8
+		if count > 4 {
+			offset = int(order.Uint32(tiff[entry+8:]))
+		}
+		if count < 0 || offset+count > len(tiff) {
+			return ""
+		}
+		return strings.TrimRight(string(tiff[offset:offset+count]), "\x00")
+	}
+	return ""
+}
+
+// copyrightExif creates the tiff structure of EXIF data which
+// only contains the copyright.
+func copyrightExif(copyright string) []byte {
+	value := append([]byte(copyright), 0)
+	buf := &bytes.Buffer{}
+	buf.WriteString("MM\x00\x2a")
+	binary.Write(buf, binary.BigEndian, uint32(8)) // offset of IFD0
+	binary.Write(buf, binary.BigEndian, uint16(1)) // number of entries
+	binary.Write(buf, binary.BigEndian, uint16(exifCopyrightTag))
+	binary.Write(buf, binary.BigEndian, uint16(exifASCIIType))
+	binary.Write(buf, binary.BigEndian, uint32(len(value)))
+	if len(value) <= 4 {
+		buf.Write(value)
+		buf.Write(make([]byte, 4-len(value)))
+		binary.Write(buf, binary.BigEndian, uint32(0)) // next IFD
+		return buf.Bytes()
+	}
+	binary.Write(buf, binary.BigEndian, uint32(26)) // offset of value
+	binary.Write(buf, binary.BigEndian, uint32(0))  // next IFD
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+// keptExif returns the EXIF data which should replace
+// the given one or nil if it should be removed.
+func keptExif(tiff []byte, keep MetadataOptions) []byte {
+	if !keep.Copyright {
+		return nil
+	}
+	if copyright := exifCopyright(tiff); copyright != "" {
+		return copyrightExif(copyright)
+	}
+	return nil
+}
+
+func stripJPEGMetadata(buf []byte, keep MetadataOptions) ([]byte, error) {
+	out := &bytes.Buffer{}
+	out.Write(buf[:2])
+	pos := 2
+	for {
+		if pos+2 > len(buf) || buf[pos] != 0xff {
+			return nil, fmt.Errorf("Could not strip metadata: invalid jpeg segment")
+		}
+		marker := buf[pos+1]
+		switch {
+		case marker == 0xff:
+			// fill bytes
+			pos++
+			continue
+		case marker == 0x01, marker >= 0xd0 && marker <= 0xd7:
+			// TEM and RST markers stand alone without length
+			out.Write(buf[pos : pos+2])
+			pos += 2
+			continue
+		case marker == 0xda, marker == 0xd9:
+			// start of scan is followed by the compressed data
+			// and nothing is stripped after the end of image
+			out.Write(buf[pos:])
+			return out.Bytes(), nil
+		}
+		if pos+4 > len(buf) {
+			return nil, fmt.Errorf("Could not strip metadata: invalid jpeg segment")
+		}
+		length := int(binary.BigEndian.Uint16(buf[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(buf) {
+			return nil, fmt.Errorf("Could not strip metadata: invalid jpeg segment")
+		}
+		data := buf[pos+4 : end]
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(data, exifHeader):
+			if exif := keptExif(data, keep); exif != nil {
+				payload := append(append([]byte{}, exifHeader...), exif...)
+				out.Write([]byte{0xff, 0xe1})
+				binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+				out.Write(payload)
+			}
+		case marker == 0xe2 && bytes.HasPrefix(data, iccProfileHeader):
+			if keep.ICCProfile {
+				out.Write(buf[pos:end])
+			}
+		case marker == 0xe0 || marker == 0xee:
+			// JFIF and Adobe segments affect decoding
+			out.Write(buf[pos:end])
+		case marker >= 0xe1 && marker <= 0xef, marker == 0xfe:
+			// other application segments and comments
+		default:
+			out.Write(buf[pos:end])
+		}
+		pos = end
+	}
+}
+
+func writePNGChunk(out *bytes.Buffer, chunkType string, data []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(data)))
+	out.WriteString(chunkType)
+	out.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	binary.Write(out, binary.BigEndian, crc.Sum32())
+}
+
+func stripPNGMetadata(buf []byte, keep MetadataOptions) ([]byte, error) {
+	out := &bytes.Buffer{}
+	out.Write(pngSignature)
+	pos := len(pngSignature)
+	for pos < len(buf) {
+		if pos+12 > len(buf) {
+			return nil, fmt.Errorf("Could not strip metadata: invalid png chunk")
+		}
+		length := int(binary.BigEndian.Uint32(buf[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(buf) {
+			return nil, fmt.Errorf("Could not strip metadata: invalid png chunk")
+		}
+		chunkType := string(buf[pos+4 : pos+8])
+		data := buf[pos+8 : pos+8+length]
+		switch chunkType {
+		case "eXIf":
+			if exif := keptExif(data, keep); exif != nil {
+				writePNGChunk(out, chunkType, exif)
+			}
+		case "iCCP":
+			if keep.ICCProfile {
+				out.Write(buf[pos:end])
+			}
+		case "tEXt", "zTXt", "iTXt":
+			if keep.Copyright && bytes.HasPrefix(data, []byte("Copyright\x00")) {
+				out.Write(buf[pos:end])
+			}
+		case "tIME":
+		default:
+			out.Write(buf[pos:end])
+		}
+		pos = end
+	}
+	return out.Bytes(), nil
+}
+
+const (
+	webpICCFlag  = 0x20
+	webpEXIFFlag = 0x08
+	webpXMPFlag  = 0x04
+)
+
+func writeWebpChunk(out *bytes.Buffer, fourCC string, data []byte) {
+	out.WriteString(fourCC)
+	binary.Write(out, binary.LittleEndian, uint32(len(data)))
+	out.Write(data)
+	if len(data)%2 == 1 {
+		out.WriteByte(0)
+	}
+}
+
+// stripWebpMetadata removes the metadata chunks of extended webp
+// images. Simple webp images do not have metadata.
+func stripWebpMetadata(buf []byte, keep MetadataOptions) ([]byte, error) {
+	if string(buf[12:16]) != "VP8X" {
+		return buf, nil
+	}
+	out := &bytes.Buffer{}
+	out.Write(buf[:12])
+	flagsPos := -1
+	var flags byte
+	pos := 12
+	for pos < len(buf) {
+		if pos+8 > len(buf) {
+			return nil, fmt.Errorf("Could not strip metadata: invalid webp chunk")
+		}
+		fourCC := string(buf[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(buf[pos+4:]))
+		end := pos + 8 + length + length%2
+		if length < 0 || pos+8+length > len(buf) {
+			return nil, fmt.Errorf("Could not strip metadata: invalid webp chunk")
+		}
+		if end > len(buf) {
+			end = len(buf)
+		}
+		data := buf[pos+8 : pos+8+length]
+		switch fourCC {
+		case "VP8X":
+			if length < 10 {
+				return nil, fmt.Errorf("Could not strip metadata: invalid webp chunk")
+			}
+			flagsPos = out.Len() + 8
+			flags = data[0] &^ (webpICCFlag | webpEXIFFlag | webpXMPFlag)
+			out.Write(buf[pos:end])
+		case "EXIF":
+			if exif := keptExif(data, keep); exif != nil {
+				writeWebpChunk(out, fourCC, exif)
+				flags |= webpEXIFFlag
+			}
+		case "ICCP":
+			if keep.ICCProfile {
+				out.Write(buf[pos:end])
+				flags |= webpICCFlag
+			}
+		case "XMP ":
+		default:
+			out.Write(buf[pos:end])
+		}
+		pos = end
+	}
+	result := out.Bytes()
+	result[flagsPos] = flags
+	binary.LittleEndian.PutUint32(result[4:8], uint32(len(result)-8))
+	return result, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// testExif creates little endian EXIF data with orientation and copyright
+func testExif(orientation uint16, copyright string) []byte {
+	value := append([]byte(copyright), 0)
+	buf := &bytes.Buffer{}
+	buf.WriteString("II\x2a\x00")
+	binary.Write(buf, binary.LittleEndian, uint32(8))
+	binary.Write(buf, binary.LittleEndian, uint16(2))
+	binary.Write(buf, binary.LittleEndian, []uint16{0x0112, 3})
+	binary.Write(buf, binary.LittleEndian, uint32(1))
+	binary.Write(buf, binary.LittleEndian, []uint16{orientation, 0})
+	binary.Write(buf, binary.LittleEndian, []uint16{exifCopyrightTag, exifASCIIType})
+	binary.Write(buf, binary.LittleEndian, uint32(len(value)))
+	binary.Write(buf, binary.LittleEndian, uint32(38))
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+func jpegSegment(marker byte, data ...[]byte) []byte {
+	payload := bytes.Join(data, nil)
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func jpegMarkers(buf []byte) []byte {
+	var markers []byte
+	pos := 2
+	for buf[pos+1] != 0xda {
+		markers = append(markers, buf[pos+1])
+		pos += 2 + int(binary.BigEndian.Uint16(buf[pos+2:]))
+	}
+	return markers
+}
+
+func TestExifCopyright(t *testing.T) {
+	is := is.New(t)
+	is.Equal(exifCopyright(testExif(6, "Photo by ACME")), "Photo by ACME")
+	is.Equal(exifCopyright(append([]byte("Exif\x00\x00"), testExif(6, "Photo by ACME")...)), "Photo by ACME")
+	is.Equal(exifCopyright(copyrightExif("Photo by ACME")), "Photo by ACME")
+	is.Equal(exifCopyright(copyrightExif("ACM")), "ACM")
+	is.Equal(exifCopyright(copyrightExif("")), "")
+	is.Equal(exifCopyright([]byte("II\x2a\x00\xff\xff\xff\xff")), "")
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	jpeg := bytes.Join([][]byte{
+		{0xff, 0xd8},
+		jpegSegment(0xe0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")),
+		jpegSegment(0xe1, exifHeader, testExif(6, "Photo by ACME")),
+		jpegSegment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")),
+		jpegSegment(0xe2, iccProfileHeader, []byte("\x01\x01profile")),
+		jpegSegment(0xed, []byte("Photoshop 3.0\x00")),
+		jpegSegment(0xfe, []byte("comment")),
+		jpegSegment(0xdb, []byte("\x00quantization")),
+		jpegSegment(0xda, []byte("\x01\x01\x00\x00\x3f\x00")),
+		[]byte("compressed\xff\xd9"),
+	}, nil)
+
+	testCases := []struct {
+		name      string
+		keep      MetadataOptions
+		markers   []byte
+		copyright string
+	}{
+		{name: "strip_all", markers: []byte{0xe0, 0xdb}},
+		{name: "keep_icc", keep: MetadataOptions{ICCProfile: true}, markers: []byte{0xe0, 0xe2, 0xdb}},
+		{
+			name:      "keep_copyright",
+			keep:      MetadataOptions{Copyright: true},
+			markers:   []byte{0xe0, 0xe1, 0xdb},
+			copyright: "Photo by ACME",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			result, err := stripMetadata(jpeg, tc.keep)
+			is.NoErr(err)
+			is.Equal(jpegMarkers(result), tc.markers)
+			is.True(bytes.HasSuffix(result, []byte("compressed\xff\xd9")))
+			if tc.copyright != "" {
+				exif := result[bytes.Index(result, exifHeader):]
+				is.Equal(exifCopyright(exif), tc.copyright)
+				is.True(!bytes.Contains(result, []byte{0x12, 0x01, 0x03, 0x00})) // orientation
+			}
+		})
+	}
+
+	is := is.New(t)
+	_, err := stripMetadata([]byte{0xff, 0xd8, 0xff, 0xe1, 0xff, 0xff}, MetadataOptions{})
+	is.True(err != nil)
+	_, err = stripMetadata([]byte{0xff, 0xd8, 0xff, 0xe1}, MetadataOptions{})
+	is.True(err != nil)
+}
+
+func TestStripJPEGMetadataStandaloneMarkers(t *testing.T) {
+	is := is.New(t)
+	quantization := jpegSegment(0xdb, []byte("\x00quantization"))
+	scan := append(jpegSegment(0xda, []byte("\x01\x01\x00\x00\x3f\x00")), []byte("compressed\xff\xd0data\xff\xd9")...)
+	jpeg := bytes.Join([][]byte{
+		{0xff, 0xd8},
+		{0xff, 0xff, 0xff}, // fill bytes before a marker
+		jpegSegment(0xe1, exifHeader, testExif(6, "Photo by ACME")),
+		{0xff, 0x01},       // TEM
+		{0xff, 0xd3},       // RST3
+		{0xff, 0xff, 0xfe}, // fill bytes before a comment
+		[]byte("\x00\x09comment"),
+		quantization,
+		scan,
+	}, nil)
+
+	result, err := stripMetadata(jpeg, MetadataOptions{})
+	is.NoErr(err)
+	expected := bytes.Join([][]byte{{0xff, 0xd8, 0xff, 0x01, 0xff, 0xd3}, quantization, scan}, nil)
+	is.Equal(result, expected)
+
+	// images without scan are copied up to the end of image
+	result, err = stripMetadata([]byte{0xff, 0xd8, 0xff, 0xd0, 0xff, 0xd9}, MetadataOptions{})
+	is.NoErr(err)
+	is.Equal(result, []byte{0xff, 0xd8, 0xff, 0xd0, 0xff, 0xd9})
+}
+
+func TestStripRotatedJPEGMetadata(t *testing.T) {
+	is := is.New(t)
+	rotated, err := ioutil.ReadFile(testFileRotated)
+	is.NoErr(err)
+	is.Equal(jpegMarkers(rotated)[0], byte(0xe1))
+
+	// the fixture has orientation, GPS location and ICC profile but no copyright
+	for _, keep := range []MetadataOptions{{}, {ICCProfile: true, Copyright: true}} {
+		result, err := stripMetadata(rotated, keep)
+		is.NoErr(err)
+		is.True(!bytes.Contains(result, exifHeader))
+		is.Equal(bytes.Contains(result, iccProfileHeader), keep.ICCProfile)
+		_, err = jpeg.Decode(bytes.NewReader(result))
+		is.NoErr(err)
+	}
+}
+
+func pngChunkTypes(buf []byte) []string {
+	var types []string
+	for pos := len(pngSignature); pos < len(buf); {
+		length := int(binary.BigEndian.Uint32(buf[pos:]))
+		types = append(types, string(buf[pos+4:pos+8]))
+		pos += 12 + length
+	}
+	return types
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	is := is.New(t)
+	encoded := &bytes.Buffer{}
+	is.NoErr(png.Encode(encoded, image.NewRGBA(image.Rect(0, 0, 2, 2))))
+	ihdrEnd := len(pngSignature) + 25
+
+	withMetadata := &bytes.Buffer{}
+	withMetadata.Write(encoded.Bytes()[:ihdrEnd])
+	writePNGChunk(withMetadata, "iCCP", []byte("sRGB\x00\x00profile"))
+	writePNGChunk(withMetadata, "tEXt", []byte("Copyright\x00ACME"))
+	writePNGChunk(withMetadata, "tEXt", []byte("Comment\x00secret"))
+	writePNGChunk(withMetadata, "eXIf", testExif(1, "Photo by ACME"))
+	writePNGChunk(withMetadata, "tIME", []byte("\x07\xe4\x01\x01\x00\x00\x00"))
+	withMetadata.Write(encoded.Bytes()[ihdrEnd:])
+
+	result, err := stripMetadata(withMetadata.Bytes(), MetadataOptions{})
+	is.NoErr(err)
+	is.Equal(result, encoded.Bytes())
+
+	result, err = stripMetadata(withMetadata.Bytes(), MetadataOptions{ICCProfile: true, Copyright: true})
+	is.NoErr(err)
+	is.Equal(pngChunkTypes(result), []string{"IHDR", "iCCP", "tEXt", "eXIf", "IDAT", "IEND"})
+	is.True(!bytes.Contains(result, []byte("secret")))
+	_, err = png.Decode(bytes.NewReader(result))
+	is.NoErr(err)
+}
+
+func TestStripWebpMetadata(t *testing.T) {
+	is := is.New(t)
+	webp := func(flags byte, chunks ...[]string) []byte {
+		buf := &bytes.Buffer{}
+		buf.WriteString("RIFF\x00\x00\x00\x00WEBP")
+		writeWebpChunk(buf, "VP8X", []byte{flags, 0, 0, 0, 1, 0, 0, 1, 0, 0})
+		for _, chunk := range chunks {
+			writeWebpChunk(buf, chunk[0], []byte(chunk[1]))
+		}
+		result := buf.Bytes()
+		binary.LittleEndian.PutUint32(result[4:8], uint32(len(result)-8))
+		return result
+	}
+	iccp := []string{"ICCP", "profile"}
+	vp8 := []string{"VP8 ", "frame"}
+	exif := []string{"EXIF", string(testExif(1, "Photo by ACME"))}
+	xmp := []string{"XMP ", "<x:xmpmeta/>"}
+	withMetadata := webp(0x2c|0x10, iccp, vp8, exif, xmp)
+
+	result, err := stripMetadata(withMetadata, MetadataOptions{})
+	is.NoErr(err)
+	is.Equal(result, webp(0x10, vp8))
+
+	result, err = stripMetadata(withMetadata, MetadataOptions{ICCProfile: true, Copyright: true})
+	is.NoErr(err)
+	is.Equal(result, webp(0x28|0x10, iccp, vp8, []string{"EXIF", string(copyrightExif("Photo by ACME"))}))
+
+	width, height, err := readImageSize(bytes.NewReader(result))
+	is.NoErr(err)
+	is.Equal([]int{width, height}, []int{2, 2})
+
+	// simple webp images do not have metadata
+	simple, err := ioutil.ReadFile(testFileWEBP)
+	is.NoErr(err)
+	result, err = stripMetadata(simple, MetadataOptions{})
+	is.NoErr(err)
+	is.Equal(result, simple)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	bimg "gopkg.in/h2non/bimg.v1"
+)
+
+//NormalizeConfig is the processing of original images on upload.
+//When it is enabled, uploaded images are rotated according to their
+//EXIF orientation, converted to sRGB by their ICC profile unless it is
+//kept, stripped from metadata and downscaled to fit in max dimension
+//before being stored.
+type NormalizeConfig struct {
+	Enabled      bool            `yaml:"enabled"`
+	MaxDimension int             `yaml:"max_dimension"`
+	KeepOriginal bool            `yaml:"keep_original"`
+	KeepMetadata MetadataOptions `yaml:"keep_metadata"`
+}
+
+// normalizeQuality is the quality of re-encoded originals
+const normalizeQuality = 95
+
+// This variable makes us be able to mock normalizeImage in tests
+var normalizeFunction = normalizeImage
+
+func (nc *NormalizeConfig) validate() error {
+	if nc.MaxDimension < 0 {
+		return fmt.Errorf("Max dimension of normalize_uploads should not be negative.")
+	}
+	return nil
+}
+
+func getOriginalPathFromImageID(dataDir string, imageID string) string {
+	return getFilePathFromImageID(dataDir, imageID) + ".original"
+}
+
+// normalizeImage processes the uploaded image according
+// to the config and returns it in its own format.
+func normalizeImage(buf []byte, config *NormalizeConfig) ([]byte, error) {
+	img := bimg.NewImage(buf)
+	metadata, err := img.Metadata()
+	if err != nil {
+		return nil, &ConversionError{err}
+	}
+	options := bimg.Options{
+		Quality:       normalizeQuality,
+		StripMetadata: !config.KeepMetadata.keepsAny(),
+		Type:          bimg.DetermineImageType(buf),
+	}
+	setSRGBTransform(&options, metadata, config.KeepMetadata)
+	width, height := orientedSize(metadata)
+	if max := config.MaxDimension; max > 0 && (width > max || height > max) {
+		// the other side is scaled by keeping aspect ratio
+		if width >= height {
+			options.Width = max
+		} else {
+			options.Height = max
+		}
+	}
+	result, err := img.Process(options)
+	if err != nil {
+		return nil, &ConversionError{err}
+	}
+	if !config.KeepMetadata.keepsAny() {
+		return result, nil
+	}
+	if result, err = stripMetadata(result, config.KeepMetadata); err != nil {
+		return nil, &ConversionError{err}
+	}
+	return result, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+	bimg "gopkg.in/h2non/bimg.v1"
+)
+
+func TestNormalizeImage(t *testing.T) {
+	is := is.New(t)
+	for _, path := range []string{testFileJPEG, testFilePNG} {
+		buf, err := ioutil.ReadFile(path)
+		is.NoErr(err)
+		result, err := normalizeImage(buf, &NormalizeConfig{Enabled: true, MaxDimension: 500})
+		is.NoErr(err)
+		size, err := bimg.Size(result)
+		is.NoErr(err)
+		is.Equal(size.Width, 500)
+		is.Equal(bimg.DetermineImageType(result), bimg.DetermineImageType(buf))
+	}
+}
+
+func TestNormalizedUploadColours(t *testing.T) {
+	profile, err := ioutil.ReadFile(testFileProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keep := range []MetadataOptions{{}, {ICCProfile: true}} {
+		keep := keep
+		t.Run(fmt.Sprintf("keep_icc_%t", keep.ICCProfile), func(t *testing.T) {
+			is := is.New(t)
+			config := getTestConfig()
+			config.NormalizeUploads = NormalizeConfig{Enabled: true, KeepMetadata: keep}
+			server := createServer(config)
+			defer os.RemoveAll(config.DataDir)
+
+			resp := serve(server, createUploadRequest("POST", defaultToken, "image_file", testFileRotated))
+			is.Equal(resp.StatusCode(), 200)
+			uploadResult := &UploadResult{}
+			is.NoErr(json.Unmarshal(resp.Body(), uploadResult))
+			stored, err := ioutil.ReadFile(getFilePathFromImageID(config.DataDir, uploadResult.ImageID))
+			is.NoErr(err)
+
+			img, err := jpeg.Decode(bytes.NewReader(stored))
+			is.NoErr(err)
+			is.Equal(img.Bounds().Size(), image.Pt(200, 300))
+			is.True(!bytes.Contains(stored, exifHeader))
+
+			// the fixture has a profile with swapped red and blue primaries,
+			// so its pixels are swapped when they are converted to sRGB
+			topRight, bottomLeft := image.Pt(190, 10), image.Pt(10, 290)
+			if keep.ICCProfile {
+				is.True(bytes.Contains(stored, profile))
+				topRight, bottomLeft = bottomLeft, topRight
+			} else {
+				is.True(!bytes.Contains(stored, iccProfileHeader))
+			}
+			r, _, b, _ := img.At(topRight.X, topRight.Y).RGBA()
+			is.True(r > b)
+			r, _, b, _ = img.At(bottomLeft.X, bottomLeft.Y).RGBA()
+			is.True(b > r)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+//RateLimit is the budget of a token bucket. Rate is the number of
+//requests per second which are refilled and Burst is the capacity of
+//the bucket. Zero rate disables the limit.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+//RateLimitConfig holds the per-client rate limits of image api.
+//Requests served from disk and requests which need conversion
+//consume separate budgets.
+type RateLimitConfig struct {
+	CacheHits      RateLimit `yaml:"cache_hits"`
+	Conversions    RateLimit `yaml:"conversions"`
+	TrustedProxies []string  `yaml:"trusted_proxies"`
+}
+
+func (rl *RateLimit) validate(name string) error {
+	if rl.Rate < 0 {
+		return fmt.Errorf("Rate of %s rate limit should not be negative.", name)
+	}
+	if rl.Rate > 0 && rl.Burst < 1 {
+		return fmt.Errorf("Burst of %s rate limit should be greater than zero.", name)
+	}
+	return nil
+}
+
+// parseNetworks parses a list of CIDRs or single ip addresses.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		cidr := network
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Trusted proxy %s is not valid.", network)
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the remote address of the request. If the request is
+// coming from a trusted proxy, the rightmost address of X-Forwarded-For
+// header which is not a trusted proxy is returned.
+func clientIP(ctx *fasthttp.RequestCtx, trustedProxies []*net.IPNet) string {
+	ip := ctx.RemoteIP()
+	if !networksContain(trustedProxies, ip) {
+		return ip.String()
+	}
+	forwardedFor := bytes.Split(ctx.Request.Header.Peek("X-Forwarded-For"), []byte(","))
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(string(bytes.TrimSpace(forwardedFor[i])))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !networksContain(trustedProxies, ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//RateLimiter is a set of token buckets keyed by client address
+type RateLimiter struct {
+	rate        float64
+	burst       float64
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+	sync.Mutex
+}
+
+//NewRateLimiter creates a rate limiter from the given budget.
+//It returns nil if the limit is disabled. nil rate limiters
+//allow every request.
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	if limit.Rate == 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:        limit.Rate,
+		burst:       float64(limit.Burst),
+		buckets:     make(map[string]*bucket),
+		lastCleanup: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the key. If the bucket is
+// empty, it returns false and the duration after which a token will
+// be available.
+func (rl *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	rl.cleanup(now)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// cleanup removes the buckets which have been refilled completely,
+// since they are the same as new buckets.
+func (rl *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(rl.lastCleanup) < time.Minute {
+		return
+	}
+	rl.lastCleanup = now
+	refillTime := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > refillTime {
+			delete(rl.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/valyala/fasthttp"
+)
+
+func TestRateLimiter(t *testing.T) {
+	is := is.New(t)
+	is.True(NewRateLimiter(RateLimit{}) == nil)
+	var disabled *RateLimiter
+	allowed, _ := disabled.Allow("1.1.1.1", time.Now())
+	is.True(allowed)
+
+	limiter := NewRateLimiter(RateLimit{Rate: 2, Burst: 3})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.Allow("1.1.1.1", now)
+		is.True(allowed)
+	}
+	allowed, wait := limiter.Allow("1.1.1.1", now)
+	is.True(!allowed)
+	is.Equal(wait, 500*time.Millisecond)
+
+	// other clients have their own buckets
+	allowed, _ = limiter.Allow("2.2.2.2", now)
+	is.True(allowed)
+
+	allowed, _ = limiter.Allow("1.1.1.1", now.Add(500*time.Millisecond))
+	is.True(allowed)
+	allowed, _ = limiter.Allow("1.1.1.1", now.Add(500*time.Millisecond))
+	is.True(!allowed)
+
+	// full buckets are removed after a while
+	limiter.Allow("3.3.3.3", now.Add(2*time.Minute))
+	is.Equal(len(limiter.buckets), 1)
+}
+
+func TestParseNetworks(t *testing.T) {
+	is := is.New(t)
+	networks, err := parseNetworks([]string{"10.0.0.0/8", "127.0.0.1", "::1"})
+	is.NoErr(err)
+	is.Equal(len(networks), 3)
+	is.Equal(networks[1].String(), "127.0.0.1/32")
+	is.Equal(networks[2].String(), "::1/128")
+	_, err = parseNetworks([]string{"localhost"})
+	is.Equal(err, fmt.Errorf("Trusted proxy localhost is not valid."))
+}
+
+func TestClientIP(t *testing.T) {
+	// remote address of requests in tests is 0.0.0.0
+	trusted, err := parseNetworks([]string{"0.0.0.0", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		name           string
+		trustedProxies []string
+		forwardedFor   string
+		expected       string
+	}{
+		{"untrusted_remote", nil, "1.1.1.1", "0.0.0.0"},
+		{"no_header", []string{"0.0.0.0"}, "", "0.0.0.0"},
+		{"single_proxy", []string{"0.0.0.0"}, "1.1.1.1", "1.1.1.1"},
+		{"spoofed_header", []string{"0.0.0.0"}, "2.2.2.2, 1.1.1.1", "1.1.1.1"},
+		{"proxy_chain", []string{"0.0.0.0", "10.0.0.0/8"}, "2.2.2.2, 1.1.1.1, 10.0.0.5", "1.1.1.1"},
+		{"invalid_address", []string{"0.0.0.0", "10.0.0.0/8"}, "hi, 10.0.0.5", "10.0.0.5"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.NewRelaxed(t)
+			networks := trusted[:len(tc.trustedProxies)]
+			ctx := &fasthttp.RequestCtx{}
+			if tc.forwardedFor != "" {
+				ctx.Request.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			}
+			is.Equal(clientIP(ctx, networks), tc.expected)
+		})
+	}
+}
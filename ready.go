@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	bimg "gopkg.in/h2non/bimg.v1"
+)
+
+const (
+	checkOK   = "ok"
+	checkFail = "fail"
+
+	// vipsCheckTimeout is the maximum time which the test
+	// conversion of readiness check can take
+	vipsCheckTimeout = 5 * time.Second
+	// vipsCheckTTL is how long the result of libvips check is reused
+	vipsCheckTTL = 5 * time.Second
+)
+
+// This variable makes us be able to mock libvips check in tests
+var vipsCheckFunction = checkVips
+
+//CheckResult is the result of one of the readiness checks
+type CheckResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+//ReadinessReport is the response body of readiness api
+type ReadinessReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckResult `json:"checks"`
+}
+
+func checkResult(message string, err error) *CheckResult {
+	if err != nil {
+		return &CheckResult{Status: checkFail, Message: err.Error()}
+	}
+	return &CheckResult{Status: checkOK, Message: message}
+}
+
+// checkDataDirWritable creates and removes a temporary
+// file in the data directory.
+func checkDataDirWritable(dataDir string) error {
+	f, err := ioutil.TempFile(dataDir, ".ready-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkFreeDiskSpace returns the free space of the file system
+// of data directory in megabytes and an error if it is less than
+// the minimum.
+func checkFreeDiskSpace(dataDir string, minFreeSpace int) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dataDir, &stat); err != nil {
+		return 0, err
+	}
+	free := stat.Bavail * uint64(stat.Bsize) / 1024 / 1024
+	if free < uint64(minFreeSpace) {
+		return free, fmt.Errorf("%d MB free is less than %d MB", free, minFreeSpace)
+	}
+	return free, nil
+}
+
+// checkVips converts a tiny image to make sure libvips is working
+func checkVips() error {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		return err
+	}
+	_, err := bimg.NewImage(buf.Bytes()).Process(bimg.Options{Width: 1, Type: bimg.WEBP})
+	return err
+}
+
+//VipsChecker runs the libvips check of readiness requests. Its result
+//is reused for a few seconds and only one check runs at a time, so
+//that frequent or abusive requests do not pile up conversions.
+type VipsChecker struct {
+	checkedAt time.Time
+	err       error
+	running   chan struct{} // closed when the running check finishes
+	sync.Mutex
+}
+
+//Check returns the result of the last check if it is recent.
+//Otherwise it starts a check unless one is running and waits for it
+//until the timeout. A check which exceeds the timeout is not stopped
+//and its result is used once it finishes.
+func (vc *VipsChecker) Check() error {
+	vc.Lock()
+	if !vc.checkedAt.IsZero() && time.Since(vc.checkedAt) < vipsCheckTTL {
+		defer vc.Unlock()
+		return vc.err
+	}
+	if vc.running == nil {
+		running := make(chan struct{})
+		vc.running = running
+		go func() {
+			err := vipsCheckFunction()
+			vc.Lock()
+			defer vc.Unlock()
+			vc.err, vc.checkedAt, vc.running = err, time.Now(), nil
+			close(running)
+		}()
+	}
+	running := vc.running
+	vc.Unlock()
+
+	select {
+	case <-running:
+		vc.Lock()
+		defer vc.Unlock()
+		return vc.err
+	case <-time.After(vipsCheckTimeout):
+		return fmt.Errorf("Conversion did not finish in %s", vipsCheckTimeout)
+	}
+}
+
+// checkReadiness runs all the checks and reports whether
+// the server can serve requests.
+func (handler *Handler) checkReadiness() *ReadinessReport {
+	config := handler.config()
+	report := &ReadinessReport{Status: checkOK, Checks: make(map[string]*CheckResult)}
+
+	report.Checks["data_directory"] = checkResult("writable", checkDataDirWritable(config.DataDir))
+
+	free, err := checkFreeDiskSpace(config.DataDir, config.MinFreeDiskSpace)
+	report.Checks["disk_space"] = checkResult(fmt.Sprintf("%d MB free", free), err)
+
+	queued, capacity := handler.TaskManager.QueueLength(), handler.TaskManager.QueueCapacity()
+	err = nil
+	if queued >= capacity {
+		err = fmt.Errorf("Queue is full with %d tasks", queued)
+	}
+	report.Checks["task_queue"] = checkResult(fmt.Sprintf("%d of %d queued", queued, capacity), err)
+
+	report.Checks["libvips"] = checkResult("", handler.VipsChecker.Check())
+
+	for _, check := range report.Checks {
+		if check.Status != checkOK {
+			report.Status = checkFail
+		}
+	}
+	return report
+}
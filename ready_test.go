@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestVipsCheckerRunsOneCheckAtATime(t *testing.T) {
+	is := is.New(t)
+	release := make(chan struct{})
+	calls := 0
+	vipsCheckFunction = func() error {
+		calls++
+		<-release
+		return fmt.Errorf("vips error")
+	}
+	defer func() { vipsCheckFunction = checkVips }()
+
+	checker := &VipsChecker{}
+	var wg sync.WaitGroup
+	errors := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errors <- checker.Check()
+		}()
+	}
+	// all the requests wait for the same check
+	waitFor(is, func() bool {
+		checker.Lock()
+		defer checker.Unlock()
+		return checker.running != nil
+	})
+	close(release)
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		is.Equal(err, fmt.Errorf("vips error"))
+	}
+
+	// result is reused until it expires
+	is.Equal(checker.Check(), fmt.Errorf("vips error"))
+	is.Equal(calls, 1)
+	checker.checkedAt = time.Now().Add(-vipsCheckTTL)
+	is.Equal(checker.Check(), fmt.Errorf("vips error"))
+	is.Equal(calls, 2)
+}
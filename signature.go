@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var validUploadFormats = []string{"jpeg", "png", "webp"}
+
+//UploadPolicy is the set of restrictions which are signed
+//in pre-signed upload urls.
+type UploadPolicy struct {
+	Expires int64    // unix timestamp
+	MaxSize int64    // in bytes. zero means the tenant's limit
+	Formats []string // empty means all the accepted formats
+}
+
+func sign(key string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signatureIsValid(key string, payload string, signature string) bool {
+	return hmac.Equal([]byte(sign(key, payload)), []byte(signature))
+}
+
+func (p *UploadPolicy) query() string {
+	return fmt.Sprintf(
+		"expires=%d&formats=%s&max_size=%d",
+		p.Expires, strings.Join(p.Formats, ","), p.MaxSize,
+	)
+}
+
+// signUploadURL returns the path of upload api with the policy and
+// its signature as query arguments. Signature covers the path as well,
+// so an upload url of one tenant is not usable for another one.
+func signUploadURL(key string, path string, policy *UploadPolicy) string {
+	query := policy.query()
+	signature := sign(key, path+"?"+query)
+	return fmt.Sprintf("%s?%s&signature=%s", path, query, signature)
+}
+
+// parseUploadPolicy reads the policy from query arguments
+// and verifies its signature and expiry.
+func parseUploadPolicy(key string, path string, query *fasthttp.Args, now time.Time) (*UploadPolicy, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("Signing is not enabled")
+	}
+	policy := &UploadPolicy{}
+	var err error
+	if policy.Expires, err = strconv.ParseInt(string(query.Peek("expires")), 10, 64); err != nil {
+		return nil, fmt.Errorf("expires should be integer")
+	}
+	if policy.MaxSize, err = strconv.ParseInt(string(query.Peek("max_size")), 10, 64); err != nil {
+		return nil, fmt.Errorf("max_size should be integer")
+	}
+	if formats := string(query.Peek("formats")); formats != "" {
+		policy.Formats = strings.Split(formats, ",")
+	}
+	if !signatureIsValid(key, path+"?"+policy.query(), string(query.Peek("signature"))) {
+		return nil, fmt.Errorf("Signature is not valid")
+	}
+	if now.Unix() > policy.Expires {
+		return nil, fmt.Errorf("Signature is expired")
+	}
+	return policy, nil
+}
+
+// signImageURL returns the image path with its expiry and signature
+// as query arguments. It is used for serving private images.
+func signImageURL(key string, path string, expires int64) string {
+	query := fmt.Sprintf("expires=%d", expires)
+	signature := sign(key, path+"?"+query)
+	return fmt.Sprintf("%s?%s&signature=%s", path, query, signature)
+}
+
+// verifyImageSignature checks the signature and expiry
+// of an image url created by signImageURL.
+func verifyImageSignature(key string, path string, query *fasthttp.Args, now time.Time) error {
+	if len(key) == 0 {
+		return fmt.Errorf("Signing is not enabled")
+	}
+	expires, err := strconv.ParseInt(string(query.Peek("expires")), 10, 64)
+	if err != nil {
+		return fmt.Errorf("expires should be integer")
+	}
+	payload := fmt.Sprintf("%s?expires=%d", path, expires)
+	if !signatureIsValid(key, payload, string(query.Peek("signature"))) {
+		return fmt.Errorf("Signature is not valid")
+	}
+	if now.Unix() > expires {
+		return fmt.Errorf("Signature is expired")
+	}
+	return nil
+}
+
+func (p *UploadPolicy) allowsFormat(format string) bool {
+	if len(p.Formats) == 0 {
+		return true
+	}
+	for _, f := range p.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func validateUploadFormats(formats []string) error {
+	for _, format := range formats {
+		valid := false
+		for _, f := range validUploadFormats {
+			if f == format {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("Supported formats are jpeg, png and webp")
+		}
+	}
+	return nil
+}
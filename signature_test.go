@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/valyala/fasthttp"
+)
+
+func TestUploadPolicySignature(t *testing.T) {
+	key := "secret"
+	now := time.Unix(1600000000, 0)
+	policy := &UploadPolicy{
+		Expires: now.Unix() + 60,
+		MaxSize: 1024,
+		Formats: []string{"jpeg", "png"},
+	}
+	signedURL := signUploadURL(key, "/upload/", policy)
+
+	tt := []struct {
+		name string
+		key  string
+		path string
+		uri  string
+		now  time.Time
+		err  error
+	}{
+		{"valid", key, "/upload/", signedURL, now, nil},
+		{"wrong_key", "secret2", "/upload/", signedURL, now, fmt.Errorf("Signature is not valid")},
+		{"signing_disabled", "", "/upload/", signedURL, now, fmt.Errorf("Signing is not enabled")},
+		{"other_tenant", key, "/blog/upload/", signedURL, now, fmt.Errorf("Signature is not valid")},
+		{"expired", key, "/upload/", signedURL, now.Add(61 * time.Second), fmt.Errorf("Signature is expired")},
+		{
+			"tampered_size", key, "/upload/",
+			fmt.Sprintf("/upload/?expires=%d&formats=jpeg,png&max_size=4096&signature=%s",
+				policy.Expires, sign(key, "/upload/?"+policy.query())),
+			now, fmt.Errorf("Signature is not valid"),
+		},
+		{"missing_args", key, "/upload/", "/upload/?signature=abc", now, fmt.Errorf("expires should be integer")},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.NewRelaxed(t)
+			uri := fasthttp.AcquireURI()
+			defer fasthttp.ReleaseURI(uri)
+			uri.Update(tc.uri)
+			result, err := parseUploadPolicy(tc.key, tc.path, uri.QueryArgs(), tc.now)
+			if tc.err != nil {
+				is.Equal(err, tc.err)
+			} else {
+				is.NoErr(err)
+				is.Equal(result, policy)
+			}
+		})
+	}
+}
+
+func TestUploadPolicyAllowsFormat(t *testing.T) {
+	is := is.New(t)
+	policy := &UploadPolicy{}
+	is.True(policy.allowsFormat("webp"))
+	policy.Formats = []string{"jpeg"}
+	is.True(policy.allowsFormat("jpeg"))
+	is.True(!policy.allowsFormat("png"))
+	is.NoErr(validateUploadFormats([]string{"jpeg", "png", "webp"}))
+	is.Equal(validateUploadFormats([]string{"gif"}), fmt.Errorf("Supported formats are jpeg, png and webp"))
+}
+
+func TestImageSignature(t *testing.T) {
+	key := "secret"
+	now := time.Unix(1600000000, 0)
+	signedURL := signImageURL(key, "/image/w=500/NG4uQBa2f", now.Unix()+60)
+
+	tt := []struct {
+		name string
+		path string
+		now  time.Time
+		err  error
+	}{
+		{"valid", "/image/w=500/NG4uQBa2f", now, nil},
+		{"other_variant", "/image/w=300/NG4uQBa2f", now, fmt.Errorf("Signature is not valid")},
+		{"expired", "/image/w=500/NG4uQBa2f", now.Add(time.Minute + time.Second), fmt.Errorf("Signature is expired")},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.NewRelaxed(t)
+			uri := fasthttp.AcquireURI()
+			defer fasthttp.ReleaseURI(uri)
+			uri.Update(signedURL)
+			is.Equal(verifyImageSignature(key, tc.path, uri.QueryArgs(), tc.now), tc.err)
+		})
+	}
+}
@@ -1,23 +1,66 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
+var (
+	//ErrShuttingDown is returned for the tasks which are
+	//requested or abandoned during shutdown
+	ErrShuttingDown = fmt.Errorf("Server is shutting down")
+	//ErrTaskTimeout is returned when the context of waiter
+	//reaches its deadline before the task is finished
+	ErrTaskTimeout = fmt.Errorf("Task timed out")
+	//ErrTaskCancelled is returned when the context of waiter
+	//is cancelled before the task is finished
+	ErrTaskCancelled = fmt.Errorf("Task cancelled")
+	//ErrQueueFull is returned for new tasks when the number
+	//of queued tasks has reached the maximum queue length
+	ErrQueueFull = fmt.Errorf("Task queue is full")
+)
+
+//PanicError is returned when the function of task panics
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Task failed: %v", e.Value)
+}
+
 //ProcessFunc is the function responsible for handling task
 type ProcessFunc func() error
 
+//Priority of a task decides which queue it is put in
+type Priority int
+
+const (
+	//PriorityInteractive is used for the tasks which users are waiting for.
+	//They are always dequeued before background tasks.
+	PriorityInteractive Priority = iota
+	//PriorityBackground is used for the tasks like warming caches
+	PriorityBackground
+)
+
 type task struct {
+	id       string
 	finished chan struct{}
 	function *ProcessFunc
 	err      error
+	waiters  int
+	started  bool
+	priority Priority
+	cost     int64
 }
 
 func (t *task) run() {
 	defer func() {
 		if r := recover(); r != nil {
-			t.err = fmt.Errorf("Task failed: %v", r)
+			t.err = &PanicError{r}
 			close(t.finished)
 		}
 	}()
@@ -33,56 +76,291 @@ func (t *task) run() {
 //that the image conversion process only happens once.
 //TaskManager also acts a worker pool and prevents from
 //running Convert function in thousands of goroutines.
+//When a memory budget is set, tasks are only started
+//if their estimated memory cost fits in the budget.
 type TaskManager struct {
-	tasks   map[string]*task
-	request chan *task
+	tasks           map[string]*task
+	queues          [2][]*task // indexed by priority
+	workers         int
+	reservedWorkers int
+	maxQueueLength  int
+	memoryBudget    int64
+	memoryUsed      int64
+	closed          bool
+	stopped         bool
+	cond            *sync.Cond
+	wg              sync.WaitGroup
 	sync.Mutex
 }
 
-//NewTaskManager takes the number of background workers
-//and creates a new Task manager with spawned workers
-func NewTaskManager(workersCount int) *TaskManager {
+//NewTaskManager takes the number of background workers, the number
+//of them which only run interactive tasks and the maximum number of
+//queued tasks and creates a new Task manager with spawned workers.
+//Zero queue length means unlimited.
+func NewTaskManager(workersCount int, reservedWorkers int, maxQueueLength int) *TaskManager {
 	t := &TaskManager{
-		tasks:   make(map[string]*task),
-		request: make(chan *task, workersCount),
+		tasks:           make(map[string]*task),
+		workers:         workersCount,
+		reservedWorkers: reservedWorkers,
+		maxQueueLength:  maxQueueLength,
 	}
+	t.cond = sync.NewCond(&t.Mutex)
 	t.startWorkers(workersCount)
 	return t
 }
 
 func (tm *TaskManager) startWorkers(count int) {
 	for i := 0; i < count; i++ {
-		go func() {
-			for t := range tm.request {
-				t.run()
+		go tm.work(i < tm.reservedWorkers)
+	}
+}
+
+// dequeue pops the first interactive task or the first background
+// task if there is no interactive one and the worker is not reserved.
+// Tasks are not skipped when the first one does not fit in the memory
+// budget, so that large images are not starved by small ones.
+// tm should be locked.
+func (tm *TaskManager) dequeue(reserved bool) *task {
+	for priority, queue := range tm.queues {
+		if Priority(priority) == PriorityBackground && reserved {
+			break
+		}
+		if len(queue) == 0 {
+			continue
+		}
+		if !tm.fitsInMemory(queue[0].cost) {
+			return nil
+		}
+		tm.queues[priority] = queue[1:]
+		tm.memoryUsed += queue[0].cost
+		return queue[0]
+	}
+	return nil
+}
+
+// fitsInMemory reports whether a task with the given cost can be
+// started. A task which is larger than the whole budget is run when
+// no other task is running. tm should be locked.
+func (tm *TaskManager) fitsInMemory(cost int64) bool {
+	return tm.memoryBudget == 0 || tm.memoryUsed == 0 || tm.memoryUsed+cost <= tm.memoryBudget
+}
+
+func (tm *TaskManager) work(reserved bool) {
+	tm.Lock()
+	defer tm.Unlock()
+	for {
+		t := tm.dequeue(reserved)
+		for t == nil && !tm.stopped {
+			tm.cond.Wait()
+			t = tm.dequeue(reserved)
+		}
+		if tm.stopped {
+			if t != nil {
+				tm.memoryUsed -= t.cost
+				tm.abandon(t)
 			}
-		}()
+			return
+		}
+		t.started = true
+		tm.Unlock()
+
+		t.run()
+
+		tm.Lock()
+		tm.memoryUsed -= t.cost
+		if t.cost > 0 {
+			// waiting workers may be able to start their tasks now
+			tm.cond.Broadcast()
+		}
+		tm.finish(t)
+	}
+}
+
+// finish removes the task from tasks. tm should be locked.
+func (tm *TaskManager) finish(t *task) {
+	if tm.tasks[t.id] == t {
+		delete(tm.tasks, t.id)
+	}
+	tm.wg.Done()
+}
+
+// abandon fails the queued task with ErrShuttingDown. tm should be locked.
+func (tm *TaskManager) abandon(t *task) {
+	t.err = ErrShuttingDown
+	close(t.finished)
+	tm.finish(t)
+}
+
+// removeFromQueue removes the task from its queue and reports
+// whether it was found. tm should be locked.
+func (tm *TaskManager) removeFromQueue(t *task) bool {
+	queue := tm.queues[t.priority]
+	for i, queued := range queue {
+		if queued == t {
+			tm.queues[t.priority] = append(queue[:i], queue[i+1:]...)
+			return true
+		}
 	}
+	return false
+}
+
+func (tm *TaskManager) queueLength() int {
+	return len(tm.queues[PriorityInteractive]) + len(tm.queues[PriorityBackground])
 }
 
-func (tm *TaskManager) clear(taskID string) {
+//QueueLength returns the number of tasks which are
+//waiting for a worker
+func (tm *TaskManager) QueueLength() int {
 	tm.Lock()
-	delete(tm.tasks, taskID)
-	tm.Unlock()
+	defer tm.Unlock()
+	return tm.queueLength()
+}
+
+//QueueCapacity returns the maximum queue length or the number
+//of workers if the queue length is unlimited
+func (tm *TaskManager) QueueCapacity() int {
+	tm.Lock()
+	defer tm.Unlock()
+	if tm.maxQueueLength > 0 {
+		return tm.maxQueueLength
+	}
+	return tm.workers
+}
+
+//SetMaxQueueLength changes the maximum number of queued tasks.
+//Tasks which are already queued are not affected.
+func (tm *TaskManager) SetMaxQueueLength(maxQueueLength int) {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.maxQueueLength = maxQueueLength
 }
 
-//RunTask takes a uniqe taskID and a processing function
-//and runs the function in the background
-func (tm *TaskManager) RunTask(taskID string, f ProcessFunc) error {
+//SetMemoryBudget changes the total estimated memory cost of the tasks
+//which can run at the same time. Zero budget means unlimited.
+func (tm *TaskManager) SetMemoryBudget(budget int64) {
 	tm.Lock()
+	defer tm.Unlock()
+	tm.memoryBudget = budget
+	tm.cond.Broadcast()
+}
+
+//RunTask takes a uniqe taskID, the estimated memory cost of the
+//task in bytes and a processing function and runs the function
+//in the background with interactive priority. It waits for the result until the context is done.
+//When all the waiters of a queued task are gone, the task is
+//cancelled. Running tasks can not be interrupted and their results
+//are discarded. New tasks are rejected with ErrQueueFull when the
+//queue is full.
+func (tm *TaskManager) RunTask(ctx context.Context, taskID string, cost int64, f ProcessFunc) error {
+	return tm.runTask(ctx, taskID, PriorityInteractive, cost, f)
+}
+
+//RunBackgroundTask is like RunTask but the task is only run
+//when there is no interactive task in the queue and it is never
+//run by the workers which are reserved for interactive tasks.
+//It is meant for work like pre-generating variants, which the
+//server does not submit yet.
+func (tm *TaskManager) RunBackgroundTask(ctx context.Context, taskID string, cost int64, f ProcessFunc) error {
+	return tm.runTask(ctx, taskID, PriorityBackground, cost, f)
+}
+
+func (tm *TaskManager) runTask(ctx context.Context, taskID string, priority Priority, cost int64, f ProcessFunc) error {
+	tm.Lock()
+	if tm.closed {
+		tm.Unlock()
+		return ErrShuttingDown
+	}
 	t := tm.tasks[taskID]
 	if t == nil {
 		// similar task does not exist at the moment
-		t = &task{finished: make(chan struct{}), function: &f}
+		if tm.maxQueueLength > 0 && tm.queueLength() >= tm.maxQueueLength {
+			tm.Unlock()
+			return ErrQueueFull
+		}
+		t = &task{id: taskID, finished: make(chan struct{}), function: &f, priority: priority, cost: cost}
 		tm.tasks[taskID] = t
+		tm.queues[priority] = append(tm.queues[priority], t)
+		tm.wg.Add(1)
+		// reserved workers may not be able to run the task,
+		// so all the workers are woken up
+		tm.cond.Broadcast()
+	} else if priority < t.priority && !t.started && tm.removeFromQueue(t) {
+		// a user is waiting for the background task
+		t.priority = priority
+		tm.queues[priority] = append(tm.queues[priority], t)
+		tm.cond.Broadcast()
+	}
+	t.waiters++
+	tm.Unlock()
+
+	select {
+	case <-t.finished:
+		tm.leave(t)
+		return t.err
+	case <-ctx.Done():
+		tm.leave(t)
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrTaskTimeout
+		}
+		return ErrTaskCancelled
+	}
+}
+
+// leave removes a waiter from the task and cancels
+// the task if it has not been started and has no waiters.
+func (tm *TaskManager) leave(t *task) {
+	tm.Lock()
+	defer tm.Unlock()
+	t.waiters--
+	if t.waiters > 0 || t.started {
+		return
+	}
+	if tm.removeFromQueue(t) {
+		t.err = ErrTaskCancelled
+		close(t.finished)
+		tm.finish(t)
+	}
+}
+
+//Shutdown stops accepting new tasks and waits for the queued and
+//running tasks until the timeout. Then it stops the workers and
+//returns the ids of the tasks which have not been finished.
+//Queued tasks which are abandoned fail with ErrShuttingDown.
+func (tm *TaskManager) Shutdown(timeout time.Duration) []string {
+	tm.Lock()
+	if tm.closed {
 		tm.Unlock()
-		tm.request <- t
-		<-t.finished
-		tm.clear(taskID)
-	} else {
-		// task is being done by another process
-		tm.Unlock()
-		<-t.finished
+		return nil
+	}
+	tm.closed = true
+	tm.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		tm.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+
+	tm.Lock()
+	defer tm.Unlock()
+	tm.stopped = true
+	tm.cond.Broadcast()
+
+	abandoned := make([]string, 0, len(tm.tasks))
+	for taskID := range tm.tasks {
+		abandoned = append(abandoned, taskID)
+	}
+	sort.Strings(abandoned)
+
+	for priority, queue := range tm.queues {
+		for _, t := range queue {
+			tm.abandon(t)
+		}
+		tm.queues[priority] = nil
 	}
-	return t.err
+	return abandoned
 }
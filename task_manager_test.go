@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// waitUntil polls the state of the task manager until the condition is true
+func waitUntil(tm *TaskManager, condition func() bool) {
+	for {
+		tm.Lock()
+		ok := condition()
+		tm.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTaskManagerShutdownWaitsForTasks(t *testing.T) {
+	is := is.New(t)
+	tm := NewTaskManager(1, 0, 0)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var err error
+	go func() {
+		defer wg.Done()
+		err = tm.RunTask(context.Background(), "slow", 0, func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	go func() {
+		// the task is finished while shutdown is waiting for it
+		waitUntil(tm, func() bool { return tm.closed })
+		close(release)
+	}()
+
+	abandoned := tm.Shutdown(time.Second)
+	is.Equal(len(abandoned), 0)
+	wg.Wait()
+	is.NoErr(err)
+
+	// new tasks are rejected after shutdown
+	is.Equal(tm.RunTask(context.Background(), "new", 0, func() error { return nil }), ErrShuttingDown)
+	is.Equal(tm.Shutdown(time.Second), []string(nil))
+}
+
+func TestTaskManagerShutdownAbandonsTasks(t *testing.T) {
+	is := is.New(t)
+	tm := NewTaskManager(1, 0, 0)
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	errors := make(chan error, 2)
+	go func() {
+		errors <- tm.RunTask(context.Background(), "running", 0, func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	go func() {
+		errors <- tm.RunTask(context.Background(), "queued", 0, func() error { return nil })
+	}()
+	waitUntil(tm, func() bool { return tm.queueLength() == 1 })
+
+	abandoned := tm.Shutdown(20 * time.Millisecond)
+	is.Equal(abandoned, []string{"queued", "running"})
+	is.Equal(<-errors, ErrShuttingDown)
+}
+
+func TestTaskManagerTimeout(t *testing.T) {
+	is := is.New(t)
+	tm := NewTaskManager(1, 0, 0)
+	release := make(chan struct{})
+	finished := make(chan struct{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := tm.RunTask(ctx, "slow", 0, func() error {
+		<-release
+		close(finished)
+		return nil
+	})
+	is.Equal(err, ErrTaskTimeout)
+
+	// running task is not interrupted and new waiters join it
+	go close(release)
+	is.NoErr(tm.RunTask(context.Background(), "slow", 0, func() error {
+		t.Fatal("task should not run twice")
+		return nil
+	}))
+	<-finished
+}
+
+func TestTaskManagerCancelsQueuedTasksWithoutWaiters(t *testing.T) {
+	is := is.New(t)
+	tm := NewTaskManager(1, 0, 0)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go tm.RunTask(context.Background(), "running", 0, func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	calls := 0
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errors := make(chan error, 2)
+	for _, ctx := range []context.Context{ctx1, ctx2} {
+		go func(ctx context.Context) {
+			errors <- tm.RunTask(ctx, "queued", 0, func() error {
+				calls++
+				return nil
+			})
+		}(ctx)
+	}
+	waitUntil(tm, func() bool { return tm.tasks["queued"] != nil && tm.tasks["queued"].waiters == 2 })
+	is.Equal(tm.QueueLength(), 1)
+
+	// task stays in queue while it has a waiter
+	cancel1()
+	is.Equal(<-errors, ErrTaskCancelled)
+	is.Equal(tm.QueueLength(), 1)
+
+	cancel2()
+	is.Equal(<-errors, ErrTaskCancelled)
+	is.Equal(tm.QueueLength(), 0)
+
+	close(release)
+	is.NoErr(tm.RunTask(context.Background(), "other", 0, func() error { return nil }))
+	is.Equal(calls, 0)
+}
+
+func TestTaskManagerQueueFull(t *testing.T) {
+	is := is.New(t)
+	tm := NewTaskManager(1, 0, 1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go tm.RunTask(context.Background(), "running", 0, func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	go tm.RunTask(context.Background(), "queued", 0, func() error { return nil })
+	waitUntil(tm, func() bool { return tm.queueLength() == 1 })
+
+	is.Equal(tm.RunTask(context.Background(), "rejected", 0, func() error { return nil }), ErrQueueFull)
+	is.Equal(tm.QueueCapacity(), 1)
+
+	// waiters of queued tasks are not rejected
+	go close(release)
+	is.NoErr(tm.RunTask(context.Background(), "queued", 0, func() error { return nil }))
+
+	tm.SetMaxQueueLength(0)
+	is.Equal(tm.QueueCapacity(), 1)
+}
+
+func TestTaskManagerPriorities(t *testing.T) {
+	is := is.New(t)
+	tm := NewTaskManager(1, 0, 0)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go tm.RunTask(context.Background(), "running", 0, func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	var order []string
+	var mu sync.Mutex
+	record := func(id string) ProcessFunc {
+		return func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, id)
+			return nil
+		}
+	}
+	var wg sync.WaitGroup
+	run := func(id string, background bool) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if background {
+				tm.RunBackgroundTask(context.Background(), id, 0, record(id))
+			} else {
+				tm.RunTask(context.Background(), id, 0, record(id))
+			}
+		}()
+	}
+	waitQueue := func(length int) {
+		waitUntil(tm, func() bool { return tm.queueLength() == length })
+	}
+	run("background1", true)
+	waitQueue(1)
+	run("background2", true)
+	waitQueue(2)
+	run("interactive", false)
+	waitQueue(3)
+
+	// an interactive waiter promotes the queued background task
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tm.RunTask(context.Background(), "background2", 0, record("promoted"))
+	}()
+	waitUntil(tm, func() bool { return len(tm.queues[PriorityInteractive]) == 2 })
+
+	close(release)
+	wg.Wait()
+	is.Equal(order, []string{"interactive", "background2", "background1"})
+}
+
+func TestTaskManagerReservedWorkers(t *testing.T) {
+	is := is.New(t)
+	tm := NewTaskManager(2, 1, 0)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var background1Finished bool
+	go tm.RunBackgroundTask(context.Background(), "background1", 0, func() error {
+		close(started)
+		<-release
+		background1Finished = true
+		return nil
+	})
+	<-started
+
+	// the reserved worker does not run background tasks, so
+	// background2 is run after background1 by the other worker
+	errors := make(chan error)
+	go func() {
+		errors <- tm.RunBackgroundTask(context.Background(), "background2", 0, func() error {
+			if !background1Finished {
+				t.Error("background task is run by the reserved worker")
+			}
+			return nil
+		})
+	}()
+	waitUntil(tm, func() bool { return tm.queueLength() == 1 })
+
+	// but it runs interactive tasks while the other worker is busy
+	is.NoErr(tm.RunTask(context.Background(), "interactive", 0, func() error { return nil }))
+	is.Equal(tm.QueueLength(), 1)
+
+	close(release)
+	is.NoErr(<-errors)
+}
+
+func TestTaskManagerMemoryBudget(t *testing.T) {
+	is := is.New(t)
+	tm := NewTaskManager(2, 0, 0)
+	tm.SetMemoryBudget(100)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var largeFinished bool
+	go tm.RunTask(context.Background(), "large", 80, func() error {
+		close(started)
+		<-release
+		largeFinished = true
+		return nil
+	})
+	<-started
+
+	// the free worker waits until the task fits in the budget
+	errors := make(chan error)
+	go func() {
+		errors <- tm.RunTask(context.Background(), "medium", 30, func() error {
+			if !largeFinished {
+				t.Error("task is run before it fits in the memory budget")
+			}
+			return nil
+		})
+	}()
+	waitUntil(tm, func() bool { return tm.queueLength() == 1 })
+
+	close(release)
+	is.NoErr(<-errors)
+
+	// tasks larger than the budget run alone
+	is.NoErr(tm.RunTask(context.Background(), "huge", 200, func() error { return nil }))
+}
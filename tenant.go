@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	tenantNameRegex = regexp.MustCompile("^[a-z0-9_-]{1,32}$")
+
+	// tenant names are used as path prefix and should not
+	// shadow the routes of the server
+	reservedTenantNames = []string{"image", "upload", "delete", "info", "list", "health", "ready", "sign"}
+)
+
+//Tenant is a namespace with its own tokens, storage directory and limits.
+//Image IDs are scoped to the tenant, so one tenant cannot fetch or delete
+//images of another one. Limits which are not set are inherited from
+//the global config.
+type Tenant struct {
+	Name                 string      `yaml:"name"`
+	Tokens               []*APIToken `yaml:"tokens"`
+	StoragePrefix        string      `yaml:"storage_prefix"`
+	ValidImageSizes      []string    `yaml:"valid_image_sizes"`
+	ValidImageQualities  []int       `yaml:"valid_image_qualities"`
+	MaxUploadedImageSize int         `yaml:"max_uploaded_image_size"` // in megabytes
+	StorageQuota         int         `yaml:"storage_quota"`           // in megabytes
+	DataDir              string      `yaml:"-"`
+}
+
+func newDefaultTenant(cfg *Config) *Tenant {
+	tenant := &Tenant{
+		ValidImageSizes:      cfg.ValidImageSizes,
+		ValidImageQualities:  cfg.ValidImageQualities,
+		MaxUploadedImageSize: cfg.MaxUploadedImageSize,
+		DataDir:              cfg.DataDir,
+	}
+	tenant.Tokens = append(tenant.Tokens, cfg.Tokens...)
+	if len(cfg.Token) != 0 {
+		tenant.Tokens = append(tenant.Tokens, newAdminToken(cfg.Token))
+	}
+	return tenant
+}
+
+// setup validates tenant config and fills its empty fields
+// with the global values.
+func (tenant *Tenant) setup(cfg *Config) error {
+	if !tenantNameRegex.MatchString(tenant.Name) {
+		return fmt.Errorf("Tenant name %s is not valid. Use lowercase letters, digits, - and _.", tenant.Name)
+	}
+	for _, name := range reservedTenantNames {
+		if tenant.Name == name {
+			return fmt.Errorf("Tenant name %s is reserved.", tenant.Name)
+		}
+	}
+	if len(tenant.Tokens) == 0 {
+		return fmt.Errorf("Set at least one token for tenant %s.", tenant.Name)
+	}
+	if err := validateTokens(tenant.Tokens); err != nil {
+		return err
+	}
+
+	if tenant.StoragePrefix == "" {
+		tenant.StoragePrefix = filepath.Join("tenants", tenant.Name)
+	}
+	prefix := filepath.Clean(tenant.StoragePrefix)
+	topDir := strings.Split(prefix, string(filepath.Separator))[0]
+	if filepath.IsAbs(prefix) || topDir == "." || topDir == ".." || topDir == "images" || topDir == "caches" {
+		return fmt.Errorf("Storage prefix %s of tenant %s is not valid.", tenant.StoragePrefix, tenant.Name)
+	}
+	tenant.DataDir = filepath.Join(cfg.DataDir, prefix)
+
+	if len(tenant.ValidImageSizes) == 0 {
+		tenant.ValidImageSizes = cfg.ValidImageSizes
+	}
+	if len(tenant.ValidImageQualities) == 0 {
+		tenant.ValidImageQualities = cfg.ValidImageQualities
+	}
+	if tenant.MaxUploadedImageSize == 0 {
+		tenant.MaxUploadedImageSize = cfg.MaxUploadedImageSize
+	}
+	if tenant.StorageQuota < 0 {
+		return fmt.Errorf("Storage quota of tenant %s should not be negative.", tenant.Name)
+	}
+	return nil
+}
+
+// overlaps reports whether the storage directories of the tenants
+// are the same or one of them is inside the other one.
+func (tenant *Tenant) overlaps(other *Tenant) bool {
+	dir := tenant.DataDir + string(filepath.Separator)
+	otherDir := other.DataDir + string(filepath.Separator)
+	return strings.HasPrefix(dir, otherDir) || strings.HasPrefix(otherDir, dir)
+}
+
+// pathPrefix returns the prefix of the tenant's api paths.
+func (tenant *Tenant) pathPrefix() string {
+	if tenant.Name == "" {
+		return ""
+	}
+	return "/" + tenant.Name
+}
+
+// allowsPrivateImages reports whether the tenant has tokens. Without
+// tokens everyone is authorized to sign urls, so private images would
+// not be protected.
+func (tenant *Tenant) allowsPrivateImages() bool {
+	return len(tenant.Tokens) != 0
+}
+
+// imageName returns the image id prefixed with the tenant name
+// for being used in logs.
+func (tenant *Tenant) imageName(imageID string) string {
+	if tenant.Name == "" {
+		return imageID
+	}
+	return tenant.Name + "/" + imageID
+}
+
+//StorageUsage keeps track of the disk space used by
+//original images of each tenant for enforcing quotas.
+type StorageUsage struct {
+	usage map[string]int64
+	sync.Mutex
+}
+
+//NewStorageUsage creates an empty storage usage tracker.
+//Usage of each tenant is calculated on first access.
+func NewStorageUsage() *StorageUsage {
+	return &StorageUsage{usage: make(map[string]int64)}
+}
+
+func (su *StorageUsage) get(tenant *Tenant) (int64, error) {
+	usage, ok := su.usage[tenant.Name]
+	if ok {
+		return usage, nil
+	}
+	err := filepath.Walk(filepath.Join(tenant.DataDir, "images"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// kept originals of normalized images are also counted
+		name := strings.TrimSuffix(fi.Name(), ".original")
+		if !fi.IsDir() && ImageIDRegex.MatchString(name) {
+			usage += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	su.usage[tenant.Name] = usage
+	return usage, nil
+}
+
+// Reserve adds size to usage of the tenant if it does not
+// exceed the tenant's quota. Tenants without quota are not tracked.
+func (su *StorageUsage) Reserve(tenant *Tenant, size int64) (bool, error) {
+	if tenant.StorageQuota == 0 {
+		return true, nil
+	}
+	su.Lock()
+	defer su.Unlock()
+	usage, err := su.get(tenant)
+	if err != nil {
+		return false, err
+	}
+	if usage+size > int64(tenant.StorageQuota)*1024*1024 {
+		return false, nil
+	}
+	su.usage[tenant.Name] = usage + size
+	return true, nil
+}
+
+// Reset forgets the calculated usages so that
+// they are calculated again on next access.
+func (su *StorageUsage) Reset() {
+	su.Lock()
+	defer su.Unlock()
+	su.usage = make(map[string]int64)
+}
+
+// Release subtracts size from usage of the tenant.
+func (su *StorageUsage) Release(tenant *Tenant, size int64) {
+	if tenant.StorageQuota == 0 {
+		return
+	}
+	su.Lock()
+	if usage, ok := su.usage[tenant.Name]; ok {
+		su.usage[tenant.Name] = usage - size
+	}
+	su.Unlock()
+}
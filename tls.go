@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is the minimum time between checking
+// modification time of certificate files.
+const certCheckInterval = 10 * time.Second
+
+//CertReloader keeps the TLS certificate of the server and reloads it
+//whenever the certificate or key file is changed.
+type CertReloader struct {
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	sync.Mutex
+}
+
+//NewCertReloader loads the certificate and its key from the given files
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// filesModTime returns the latest modification time of certificate
+// and key files.
+func (cr *CertReloader) filesModTime() (time.Time, error) {
+	var modTime time.Time
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return modTime, err
+		}
+		if stat.ModTime().After(modTime) {
+			modTime = stat.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+//Reload loads the certificate from disk. The current certificate
+//is kept if the new one is not valid.
+func (cr *CertReloader) Reload() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return fmt.Errorf("Could not load TLS certificate: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("Could not load TLS certificate: %v", err)
+	}
+	cr.Lock()
+	defer cr.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// reloadIfChanged reloads the certificate if its files have been
+// modified since the last load.
+func (cr *CertReloader) reloadIfChanged(now time.Time) {
+	cr.Lock()
+	if now.Sub(cr.lastCheck) < certCheckInterval {
+		cr.Unlock()
+		return
+	}
+	cr.lastCheck = now
+	loadedModTime := cr.modTime
+	cr.Unlock()
+
+	modTime, err := cr.filesModTime()
+	if err != nil || !modTime.After(loadedModTime) {
+		return
+	}
+	if err := cr.Reload(); err != nil {
+		logger.Error("Could not reload TLS certificate", "error", err)
+		return
+	}
+	logger.Info("TLS certificate reloaded", "path", cr.certFile)
+}
+
+//GetCertificate is used as tls.Config.GetCertificate
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.reloadIfChanged(time.Now())
+	cr.Lock()
+	defer cr.Unlock()
+	return cr.cert, nil
+}
+
+//TLSConfig returns a tls config which serves the reloaded certificates
+func (cr *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func writeTestCert(t *testing.T, dir string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func certCommonName(t *testing.T, cr *CertReloader) string {
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "webp_server_tls")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	is.True(err != nil)
+
+	certFile, keyFile := writeTestCert(t, dir, "first")
+	cr, err := NewCertReloader(certFile, keyFile)
+	is.NoErr(err)
+	is.Equal(certCommonName(t, cr), "first")
+
+	// rotated certificate is loaded on the next check
+	writeTestCert(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	is.NoErr(os.Chtimes(certFile, future, future))
+	cr.reloadIfChanged(future.Add(certCheckInterval))
+	is.Equal(certCommonName(t, cr), "second")
+
+	// broken files do not replace the current certificate
+	is.NoErr(ioutil.WriteFile(certFile, []byte("broken"), 0600))
+	is.True(cr.Reload() != nil)
+	is.Equal(certCommonName(t, cr), "second")
+}
@@ -2,41 +2,73 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io/ioutil"
 
 	"mime/multipart"
 	"net/http"
 )
 
 func validateImage(header *multipart.FileHeader) bool {
+	return detectImageFormat(header) != ""
+}
+
+// detectImageFormat returns jpeg, png or webp based on content of
+// the file or an empty string if it is not an accepted image.
+func detectImageFormat(header *multipart.FileHeader) string {
 	file, err := header.Open()
 	if err != nil {
-		log.Println(err)
-		return false
+		logger.Error("Could not open uploaded file", "error", err)
+		return ""
 	}
 	defer file.Close()
 	buff := make([]byte, 512)
 	if _, err = file.Read(buff); err != nil {
-		log.Println(err)
-		return false
+		logger.Error("Could not read uploaded file", "error", err)
+		return ""
 	}
 	ct := http.DetectContentType(buff)
 
 	switch ct {
-	case "image/jpeg", "image/jpg", "image/png", "image/webp":
-		return true
+	case "image/jpeg", "image/jpg":
+		return "jpeg"
+	case "image/png":
+		return "png"
+	case "image/webp":
+		return "webp"
 	default:
-		return false
+		return ""
+	}
+}
+
+// validateImageDimensions reads the dimensions of uploaded image
+// from its header and checks them against the limits.
+func validateImageDimensions(header *multipart.FileHeader, limits ImageLimits) error {
+	if !limits.enabled() {
+		return nil
+	}
+	file, err := header.Open()
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	width, height, err := readImageBufferSize(buf)
+	if err != nil {
+		return err
 	}
+	return limits.check(width, height)
 }
 
-func validateImageParams(imageParams *ImageParams, config *Config) error {
+func validateImageParams(imageParams *ImageParams, tenant *Tenant, config *Config) error {
 	if config.Debug {
 		return nil
 	}
 	validSize := false
 	imageSize := fmt.Sprintf("%dx%d", imageParams.Width, imageParams.Height)
-	for _, size := range config.ValidImageSizes {
+	for _, size := range tenant.ValidImageSizes {
 		if size == imageSize {
 			validSize = true
 			break
@@ -52,7 +84,7 @@ func validateImageParams(imageParams *ImageParams, config *Config) error {
 	validQuality := imageParams.Quality == 0 || imageParams.Quality == config.DefaultImageQuality
 
 	if !validQuality && imageParams.Quality <= 100 && imageParams.Quality >= 10 {
-		for _, val := range config.ValidImageQualities {
+		for _, val := range tenant.ValidImageQualities {
 			if val == imageParams.Quality {
 				validQuality = true
 				break